@@ -0,0 +1,119 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+// Future is the result of an asynchronous write.
+type Future struct {
+	index uint64
+	done  chan struct{}
+	err   error
+}
+
+// Index returns the index of the entry.
+func (f *Future) Index() uint64 {
+	return f.index
+}
+
+// Done returns a channel that is closed when the entry has been flushed
+// and synced, or the write has failed.
+func (f *Future) Done() <-chan struct{} {
+	return f.done
+}
+
+// Err returns the error of the write after Done is closed.
+func (f *Future) Err() error {
+	select {
+	case <-f.done:
+		return f.err
+	default:
+		return nil
+	}
+}
+
+// Wait waits until the entry has been flushed and synced, and returns the error of the write.
+func (f *Future) Wait() error {
+	<-f.done
+	return f.err
+}
+
+func (f *Future) resolve(err error) {
+	f.err = err
+	close(f.done)
+}
+
+// WriteAsync writes an entry to buffer and returns a future of it. The entries
+// written asynchronously are flushed and synced together by a group commit
+// goroutine, and their futures are resolved in index order.
+func (w *WAL) WriteAsync(index uint64, data []byte) *Future {
+	f := &Future{index: index, done: make(chan struct{})}
+	w.mu.Lock()
+	if err := w.write(index, data, nil); err != nil {
+		w.mu.Unlock()
+		f.resolve(err)
+		return f
+	}
+	w.futures = append(w.futures, f)
+	if w.commitCh == nil {
+		w.commitCh = make(chan struct{}, 1)
+		w.commitDone = make(chan struct{})
+		go w.commit(w.commitCh, w.commitDone)
+	}
+	commitCh := w.commitCh
+	w.mu.Unlock()
+	select {
+	case commitCh <- struct{}{}:
+	default:
+	}
+	return f
+}
+
+// commit flushes and syncs the asynchronous writes in groups until the log is closed.
+func (w *WAL) commit(commitCh, done chan struct{}) {
+	for {
+		select {
+		case <-commitCh:
+		case <-done:
+			return
+		}
+		w.mu.Lock()
+		futures := w.futures
+		w.futures = nil
+		var err error
+		if len(futures) > 0 {
+			if err = w.flush(); err == nil {
+				err = w.sync()
+			}
+		}
+		w.mu.Unlock()
+		for _, f := range futures {
+			f.resolve(err)
+		}
+	}
+}
+
+// discardFutures resolves the pending futures of the entries after index with ErrDiscarded.
+func (w *WAL) discardFutures(index uint64) {
+	futures := w.futures[:0]
+	for _, f := range w.futures {
+		if f.index > index {
+			f.resolve(ErrDiscarded)
+		} else {
+			futures = append(futures, f)
+		}
+	}
+	w.futures = futures
+}
+
+// stopCommit resolves the pending futures with the error, and stops the group commit goroutine.
+func (w *WAL) stopCommit(err error) {
+	for _, f := range w.futures {
+		f.resolve(err)
+	}
+	w.futures = nil
+	if w.commitDone != nil {
+		close(w.commitDone)
+		w.commitDone = nil
+		w.commitCh = nil
+	}
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestWriteAsync(t *testing.T) {
+	file := "wal"
+	os.RemoveAll(file)
+	w, err := Open(file, &Options{SegmentEntries: 16})
+	if err != nil {
+		t.Error(err)
+	}
+	var futures []*Future
+	for i := uint64(1); i <= 100; i++ {
+		futures = append(futures, w.WriteAsync(i, []byte(fmt.Sprintf("entry-%d", i))))
+	}
+	for i, f := range futures {
+		if err := f.Wait(); err != nil {
+			t.Error(f.Index(), err)
+		}
+		// the futures are resolved in index order
+		for _, prev := range futures[:i] {
+			select {
+			case <-prev.Done():
+			default:
+				t.Error(prev.Index(), f.Index())
+			}
+		}
+	}
+	if f := w.WriteAsync(200, []byte("entry-200")); f.Wait() != ErrOutOfOrder || f.Err() != ErrOutOfOrder {
+		t.Error(f.Err())
+	}
+	f := w.WriteAsync(101, []byte("entry-101"))
+	w.Close()
+	if err = f.Wait(); err != nil {
+		t.Error(err)
+	}
+	if f := w.WriteAsync(102, []byte("entry-102")); f.Wait() != ErrClosed {
+		t.Error(f.Err())
+	}
+	if w, err = Open(file, nil); err != nil {
+		t.Error(err)
+	}
+	for i := uint64(1); i <= 101; i++ {
+		if data, err := w.Read(i); err != nil || string(data) != fmt.Sprintf("entry-%d", i) {
+			t.Error(i, string(data), err)
+		}
+	}
+	w.Close()
+	os.RemoveAll(file)
+}
+
+func TestWriteAsyncDiscard(t *testing.T) {
+	file := "wal"
+	os.RemoveAll(file)
+	w, err := Open(file, &Options{SegmentEntries: 16})
+	if err != nil {
+		t.Error(err)
+	}
+	// pending futures that are not committed yet
+	pending := func(first, last uint64) (futures []*Future) {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		for i := first; i <= last; i++ {
+			if err := w.write(i, []byte(fmt.Sprintf("entry-%d", i)), nil); err != nil {
+				t.Error(err)
+			}
+			f := &Future{index: i, done: make(chan struct{})}
+			w.futures = append(w.futures, f)
+			futures = append(futures, f)
+		}
+		return
+	}
+	futures := pending(1, 10)
+	if err = w.Truncate(5); err != nil {
+		t.Error(err)
+	}
+	for _, f := range futures {
+		select {
+		case <-f.Done():
+			if f.Index() <= 5 || f.Err() != ErrDiscarded {
+				t.Error(f.Index(), f.Err())
+			}
+		default:
+			if f.Index() > 5 {
+				t.Error(f.Index())
+			}
+		}
+	}
+	if err = w.ResetTo(20); err != nil {
+		t.Error(err)
+	}
+	for _, f := range futures[:5] {
+		if err := f.Wait(); err != ErrDiscarded {
+			t.Error(f.Index(), err)
+		}
+	}
+	if err = w.WriteAsync(20, []byte("entry-20")).Wait(); err != nil {
+		t.Error(err)
+	}
+	// Close resolves the futures and stops the group commit when the flush fails.
+	f := pending(21, 21)[0]
+	w.lastSegment.logFile.Close()
+	if err = w.Close(); err == nil {
+		t.Error("no error")
+	}
+	if err := f.Wait(); err == nil {
+		t.Error("no error")
+	}
+	if w.commitDone != nil {
+		t.Error("commit goroutine is not stopped")
+	}
+	os.RemoveAll(file)
+}
@@ -0,0 +1,204 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Checkpoint writes a consistent copy of the write-ahead log to dstDir, which
+// must not exist. The sealed segments are hard linked, or copied when the link
+// fails, since the log never writes into a sealed segment again. The active
+// segment is copied up to the synced size. The applied index is copied too.
+// The manifest is written last, so a checkpoint without a manifest is incomplete.
+// The checkpoint can be opened by Open with the same options.
+func (w *WAL) Checkpoint(dstDir string) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	if err = w.flush(); err != nil {
+		return err
+	}
+	if err = w.sync(); err != nil {
+		return err
+	}
+	if _, err = w.fs.Stat(dstDir); err == nil {
+		return &os.PathError{Op: "checkpoint", Path: dstDir, Err: os.ErrExist}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	if err = w.fs.MkdirAll(dstDir, w.dirMode); err != nil {
+		return err
+	}
+	m := w.manifest()
+	for i, s := range w.segments {
+		dstName := filepath.Join(dstDir, m.segments[i].name)
+		var size int64
+		if i < len(w.segments)-1 {
+			size, err = linkFile(w.fs, s.logPath, dstName)
+		} else {
+			size, err = copyFile(w.fs, s.logPath, dstName, -1)
+		}
+		if err != nil {
+			return err
+		}
+		m.segments[i].size = uint64(size)
+	}
+	if w.appliedIndex > 0 {
+		if err = writeAppliedIndex(w.fs, dstDir, w.appliedIndex); err != nil {
+			return err
+		}
+	}
+	return writeManifest(w.fs, dstDir, m)
+}
+
+// Restore replaces the write-ahead log at path with the checkpoint in dir.
+// The write-ahead log at path must be closed. The checkpoint is prepared in
+// a temporary directory next to path. The old log is renamed aside, the
+// temporary directory is renamed to path, and then the old log is removed.
+// A Restore interrupted between the renames puts the old log back.
+// The files are created with the DirMode and FileMode of the options,
+// which should be the options the log is opened with.
+func Restore(dir, path string, opts *Options) (err error) {
+	if opts != nil {
+		if err = opts.check(); err != nil {
+			return err
+		}
+	} else {
+		opts = DefaultOptions()
+	}
+	dirMode, fileMode := opts.DirMode.Perm(), opts.FileMode.Perm()
+	fs := permFS{fileSystem: osFS{}, dirMode: dirMode, fileMode: fileMode}
+	oldDir := filepath.Clean(path) + ".old"
+	if exist, err := existDir(oldDir); err != nil {
+		return err
+	} else if exist {
+		if exist, err = existDir(path); err != nil {
+			return err
+		} else if !exist {
+			if err = fs.Rename(oldDir, path); err != nil {
+				return err
+			}
+		} else if err = os.RemoveAll(oldDir); err != nil {
+			return err
+		}
+	}
+	m, err := readManifest(fs, dir)
+	if err != nil {
+		return err
+	}
+	for _, s := range m.segments {
+		info, err := fs.Stat(filepath.Join(dir, s.name))
+		if err != nil {
+			if os.IsNotExist(err) {
+				return ErrBadCheckpoint
+			}
+			return err
+		}
+		if uint64(info.Size()) != s.size {
+			return ErrBadCheckpoint
+		}
+	}
+	tmpDir := filepath.Clean(path) + ".restore"
+	if err = os.RemoveAll(tmpDir); err != nil {
+		return err
+	}
+	if err = fs.MkdirAll(tmpDir, dirMode); err != nil {
+		return err
+	}
+	for i, s := range m.segments {
+		src, dst := filepath.Join(dir, s.name), filepath.Join(tmpDir, s.name)
+		if i < len(m.segments)-1 {
+			_, err = linkFile(fs, src, dst)
+		} else {
+			// The active segment is copied, because it will be written.
+			_, err = copyFile(fs, src, dst, int64(s.size))
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if exist, err := existDir(filepath.Join(dir, appliedName)); err != nil {
+		return err
+	} else if exist {
+		if _, err = copyFile(fs, filepath.Join(dir, appliedName), filepath.Join(tmpDir, appliedName), -1); err != nil {
+			return err
+		}
+	}
+	if err = writeManifest(fs, tmpDir, m); err != nil {
+		return err
+	}
+	exist, err := existDir(path)
+	if err != nil {
+		return err
+	}
+	if exist {
+		if err = fs.Rename(path, oldDir); err != nil {
+			return err
+		}
+	}
+	if err = fs.Rename(tmpDir, path); err != nil {
+		return err
+	}
+	if err = fs.SyncDir(filepath.Dir(filepath.Clean(path))); err != nil {
+		return err
+	}
+	return os.RemoveAll(oldDir)
+}
+
+func existDir(path string) (bool, error) {
+	if _, err := os.Stat(path); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// linkFile links the file or copies it when the link fails,
+// and returns the size of the file.
+func linkFile(fs fileSystem, srcName, dstName string) (size int64, err error) {
+	if err = fs.Link(srcName, dstName); err != nil {
+		return copyFile(fs, srcName, dstName, -1)
+	}
+	info, err := fs.Stat(dstName)
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// copyFile copies size bytes of the file, or the whole file if size is negative,
+// and returns the size copied.
+func copyFile(fs fileSystem, srcName, dstName string, size int64) (n int64, err error) {
+	var srcFile, dstFile file
+	if srcFile, err = fs.Open(srcName); err != nil {
+		return 0, err
+	}
+	defer srcFile.Close()
+	if size < 0 {
+		var srcSize int
+		if srcSize, err = fsize(srcFile); err != nil {
+			return 0, err
+		}
+		size = int64(srcSize)
+	}
+	if dstFile, err = fs.Create(dstName); err != nil {
+		return 0, err
+	}
+	if n, err = io.CopyN(dstFile, srcFile, size); err != nil {
+		dstFile.Close()
+		return n, err
+	}
+	if err = dstFile.Sync(); err != nil {
+		dstFile.Close()
+		return n, err
+	}
+	return n, dstFile.Close()
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckpoint(t *testing.T) {
+	file := "wal"
+	checkpoint := "wal-checkpoint"
+	os.RemoveAll(file)
+	os.RemoveAll(checkpoint)
+	opts := &Options{SegmentEntries: 4}
+	w, err := Open(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	entry := func(i uint64) []byte {
+		return []byte(fmt.Sprintf("entry-%d", i))
+	}
+	for i := uint64(1); i <= 10; i++ {
+		w.Write(i, entry(i))
+	}
+	w.Flush()
+	if err = w.SetAppliedIndex(8); err != nil {
+		t.Error(err)
+	}
+	if err = w.Checkpoint(checkpoint); err != nil {
+		t.Error(err)
+	}
+	if err = w.Checkpoint(checkpoint); !os.IsExist(err) {
+		t.Error(err)
+	}
+	for _, s := range w.segments[:len(w.segments)-1] {
+		src, _ := os.Stat(s.logPath)
+		dst, _ := os.Stat(filepath.Join(checkpoint, filepath.Base(s.logPath)))
+		if !os.SameFile(src, dst) {
+			t.Error(s.logPath)
+		}
+	}
+	for i := uint64(11); i <= 20; i++ {
+		w.Write(i, entry(i))
+	}
+	w.Flush()
+	if err = w.Clean(6); err != nil {
+		t.Error(err)
+	}
+	if err = w.Truncate(18); err != nil {
+		t.Error(err)
+	}
+	check := func(path string, first, last uint64) {
+		c, err := Open(path, opts)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		if index, _ := c.FirstIndex(); index != first {
+			t.Error(index, first)
+		}
+		if index, _ := c.LastIndex(); index != last {
+			t.Error(index, last)
+		}
+		for i := first; i <= last; i++ {
+			if data, err := c.Read(i); err != nil {
+				t.Error(i, err)
+			} else if !bytes.Equal(data, entry(i)) {
+				t.Error(i, string(data))
+			}
+		}
+	}
+	check(checkpoint, 1, 10)
+	w.Close()
+	check(file, 6, 18)
+	if err = Restore(checkpoint, file, opts); err != nil {
+		t.Error(err)
+	}
+	check(file, 1, 10)
+	w, err = Open(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	if index, err := w.AppliedIndex(); err != nil || index != 8 {
+		t.Error(index, err)
+	}
+	for i := uint64(11); i <= 12; i++ {
+		w.Write(i, entry(i))
+	}
+	w.Close()
+	check(file, 1, 12)
+	check(checkpoint, 1, 10)
+	m, err := readManifest(osFS{}, checkpoint)
+	if err != nil {
+		t.Error(err)
+	} else if m.firstIndex != 1 || m.lastIndex != 10 || len(m.segments) != 3 {
+		t.Error(m)
+	}
+	os.Remove(filepath.Join(checkpoint, m.segments[1].name))
+	if err = Restore(checkpoint, file, opts); err != ErrBadCheckpoint {
+		t.Error(err)
+	}
+	os.RemoveAll(file)
+	os.RemoveAll(checkpoint)
+}
+
+func TestRestoreInterrupted(t *testing.T) {
+	file := "wal"
+	checkpoint := "wal-checkpoint"
+	os.RemoveAll(file)
+	os.RemoveAll(file + ".old")
+	os.RemoveAll(checkpoint)
+	opts := &Options{SegmentEntries: 4}
+	w, err := Open(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	for i := uint64(1); i <= 10; i++ {
+		w.Write(i, []byte(fmt.Sprintf("entry-%d", i)))
+	}
+	if err = w.Checkpoint(checkpoint); err != nil {
+		t.Error(err)
+	}
+	w.Write(11, []byte("entry-11"))
+	w.Close()
+	// interrupted after the old log has been renamed aside
+	if err = os.Rename(file, file+".old"); err != nil {
+		t.Error(err)
+	}
+	if err = Restore(checkpoint, file, opts); err != nil {
+		t.Error(err)
+	}
+	if _, err = os.Stat(file + ".old"); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+	// interrupted before the old log has been removed
+	os.MkdirAll(file+".old", 0744)
+	if err = Restore(checkpoint, file, opts); err != nil {
+		t.Error(err)
+	}
+	if _, err = os.Stat(file + ".old"); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+	if w, err = Open(file, opts); err != nil {
+		t.Error(err)
+	} else {
+		if last, _ := w.LastIndex(); last != 10 {
+			t.Error(last)
+		}
+		w.Close()
+	}
+	os.RemoveAll(file)
+	os.RemoveAll(checkpoint)
+}
+
+func TestCheckpointTruncate(t *testing.T) {
+	file := "wal"
+	checkpoint := "wal-checkpoint"
+	os.RemoveAll(file)
+	os.RemoveAll(checkpoint)
+	opts := &Options{SegmentSize: 60}
+	entry := func(i uint64) []byte {
+		return []byte(fmt.Sprintf("entry-%d", i))
+	}
+	check := func(path string, last uint64, lastData []byte) {
+		c, err := Open(path, opts)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer c.Close()
+		if index, _ := c.LastIndex(); index != last {
+			t.Error(path, index, last)
+		}
+		for i := uint64(1); i <= last; i++ {
+			want := entry(i)
+			if i == last && lastData != nil {
+				want = lastData
+			}
+			if data, err := c.Read(i); err != nil || !bytes.Equal(data, want) {
+				t.Error(path, i, string(data), err)
+			}
+		}
+	}
+	// truncate at a segment boundary and write into the hard linked segment
+	rewrite := func(data []byte) {
+		w, err := Open(file, opts)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if err = w.Truncate(7); err != nil {
+			t.Error(err)
+		}
+		if err = w.Write(8, data); err != nil {
+			t.Error(err)
+		}
+		if len(w.segments) != 1 {
+			t.Error(len(w.segments))
+		}
+		w.Close()
+		check(file, 8, data)
+	}
+	w, err := Open(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	for i := uint64(1); i <= 10; i++ {
+		w.Write(i, entry(i))
+	}
+	// the first segment has the entries 1..7 and room for a small entry
+	if len(w.segments) != 2 || w.segments[1].offset != 7 {
+		t.Error(len(w.segments))
+	}
+	if err = w.Checkpoint(checkpoint); err != nil {
+		t.Error(err)
+	}
+	w.Close()
+	rewrite([]byte("N"))
+	check(checkpoint, 10, nil)
+	if err = Restore(checkpoint, file, opts); err != nil {
+		t.Error(err)
+	}
+	check(file, 10, nil)
+	rewrite([]byte("M"))
+	check(checkpoint, 10, nil)
+	if err = Restore(checkpoint, file, opts); err != nil {
+		t.Error(err)
+	}
+	check(file, 10, nil)
+	os.RemoveAll(file)
+	os.RemoveAll(checkpoint)
+}
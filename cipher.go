@@ -0,0 +1,97 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"github.com/hslam/code"
+	"io"
+	"sync"
+)
+
+// NonceSize is the nonce size of an encrypted entry.
+const NonceSize = 12
+
+// KeyProvider supplies the keys to encrypt and decrypt entries.
+// A key must be 16, 24, or 32 bytes to select AES-128, AES-192, or AES-256.
+type KeyProvider interface {
+	// CurrentKey returns the key and its id to encrypt new entries.
+	CurrentKey() (id uint64, key []byte, err error)
+	// Key returns the key by id to decrypt entries.
+	Key(id uint64) (key []byte, err error)
+}
+
+// Cipher encrypts and decrypts entries by AES-GCM.
+// The key id and the nonce are stored in each record, so the keys can be rotated.
+type Cipher struct {
+	keys  KeyProvider
+	mu    sync.Mutex
+	aeads map[uint64]cipher.AEAD
+}
+
+// NewCipher returns a new cipher with the key provider.
+func NewCipher(keys KeyProvider) *Cipher {
+	return &Cipher{keys: keys, aeads: make(map[uint64]cipher.AEAD)}
+}
+
+func (c *Cipher) aead(id uint64, key []byte) (aead cipher.AEAD, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if aead = c.aeads[id]; aead != nil {
+		return aead, nil
+	}
+	if key == nil {
+		if key, err = c.keys.Key(id); err != nil {
+			return nil, err
+		}
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	if aead, err = cipher.NewGCM(block); err != nil {
+		return nil, err
+	}
+	c.aeads[id] = aead
+	return aead, nil
+}
+
+// seal appends the key id, the nonce and the encrypted src to dst.
+func (c *Cipher) seal(dst, src, additionalData []byte) ([]byte, error) {
+	id, key, err := c.keys.CurrentKey()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := c.aead(id, key)
+	if err != nil {
+		return nil, err
+	}
+	var buf [10]byte
+	dst = append(dst, buf[:code.EncodeVarint(buf[:], id)]...)
+	var nonce [NonceSize]byte
+	if _, err = io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	dst = append(dst, nonce[:]...)
+	return aead.Seal(dst, nonce[:], src, additionalData), nil
+}
+
+// open decrypts src that starts with the key id and the nonce.
+func (c *Cipher) open(src, additionalData []byte) ([]byte, error) {
+	if len(src) == 0 {
+		return nil, ErrUnexpectedSize
+	}
+	var id uint64
+	src = src[code.DecodeVarint(src, &id):]
+	if len(src) < NonceSize {
+		return nil, ErrUnexpectedSize
+	}
+	aead, err := c.aead(id, nil)
+	if err != nil {
+		return nil, err
+	}
+	return aead.Open(nil, src[:NonceSize], src[NonceSize:], additionalData)
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+type testKeys struct {
+	current uint64
+	keys    map[uint64][]byte
+}
+
+func (k *testKeys) CurrentKey() (uint64, []byte, error) {
+	return k.current, k.keys[k.current], nil
+}
+
+func (k *testKeys) Key(id uint64) ([]byte, error) {
+	if key, ok := k.keys[id]; ok {
+		return key, nil
+	}
+	return nil, errors.New("no key")
+}
+
+func TestCipher(t *testing.T) {
+	file := "wal"
+	os.RemoveAll(file)
+	keys := &testKeys{current: 1, keys: map[uint64][]byte{
+		1: bytes.Repeat([]byte{1}, 16),
+		2: bytes.Repeat([]byte{2}, 32),
+	}}
+	opts := &Options{SegmentEntries: 4, Cipher: NewCipher(keys), Compression: NewFlateCodec(flate.BestSpeed)}
+	w, err := Open(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	entry := func(i uint64) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("secret-%d", i)), int(i)*40)
+	}
+	for i := uint64(1); i <= 10; i++ {
+		if i == 6 {
+			keys.current = 2
+		}
+		if i == 5 {
+			err = w.WriteKey(i, []byte("secret-key"), entry(i))
+		} else {
+			err = w.Write(i, entry(i))
+		}
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	w.Flush()
+	for _, s := range w.segments {
+		if data, err := ioutil.ReadFile(s.logPath); err != nil {
+			t.Error(err)
+		} else if bytes.Contains(data, []byte("secret")) {
+			t.Error(s.logPath)
+		}
+	}
+	if err = w.Clean(3); err != nil {
+		t.Error(err)
+	}
+	if err = w.Truncate(9); err != nil {
+		t.Error(err)
+	}
+	w.Close()
+	w, err = Open(file, &Options{SegmentEntries: 4, Cipher: NewCipher(keys)})
+	if err != nil {
+		t.Error(err)
+	}
+	for i := uint64(3); i <= 9; i++ {
+		if data, err := w.Read(i); err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(data, entry(i)) {
+			t.Error(i, data)
+		}
+	}
+	if key, value, err := w.ReadKey(5); err != nil || string(key) != "secret-key" || !bytes.Equal(value, entry(5)) {
+		t.Error(string(key), err)
+	}
+	w.Close()
+	w, err = Open(file, &Options{SegmentEntries: 4})
+	if err != nil {
+		t.Error(err)
+	}
+	if _, err = w.Read(3); err != ErrNoCipher {
+		t.Error(err)
+	}
+	w.Close()
+	delete(keys.keys, 1)
+	w, err = Open(file, &Options{SegmentEntries: 4, Cipher: NewCipher(keys)})
+	if err != nil {
+		t.Error(err)
+	}
+	if _, err = w.Read(3); err == nil {
+		t.Error()
+	}
+	if _, err = w.Read(9); err != nil {
+		t.Error(err)
+	}
+	w.Close()
+	os.RemoveAll(file)
+}
+
+func TestCipherTamper(t *testing.T) {
+	file := "wal"
+	os.RemoveAll(file)
+	keys := &testKeys{current: 1, keys: map[uint64][]byte{1: bytes.Repeat([]byte{1}, 16)}}
+	w, err := Open(file, &Options{Cipher: NewCipher(keys)})
+	if err != nil {
+		t.Error(err)
+	}
+	w.Write(1, []byte("Hello World"))
+	w.Flush()
+	w.Close()
+	name := w.segments[0].logPath
+	data, _ := ioutil.ReadFile(name)
+	data[len(data)-1] ^= 1
+	ioutil.WriteFile(name, data, 0666)
+	w, err = Open(file, &Options{Cipher: NewCipher(keys)})
+	if err != nil {
+		t.Error(err)
+	}
+	if _, err = w.Read(1); err == nil {
+		t.Error()
+	}
+	w.Close()
+	os.RemoveAll(file)
+}
+
+func TestCipherReorder(t *testing.T) {
+	file := "wal"
+	os.RemoveAll(file)
+	keys := &testKeys{current: 1, keys: map[uint64][]byte{1: bytes.Repeat([]byte{1}, 16)}}
+	w, err := Open(file, &Options{Cipher: NewCipher(keys)})
+	if err != nil {
+		t.Error(err)
+	}
+	w.Write(1, []byte("entry-1"))
+	w.Write(2, []byte("entry-2"))
+	w.Flush()
+	w.Close()
+	// The records have the same size, so they can be swapped.
+	name := w.segments[0].logPath
+	data, _ := ioutil.ReadFile(name)
+	half := len(data) / 2
+	swapped := append(append([]byte{}, data[half:]...), data[:half]...)
+	ioutil.WriteFile(name, swapped, 0666)
+	w, err = Open(file, &Options{Cipher: NewCipher(keys)})
+	if err != nil {
+		t.Error(err)
+	}
+	for i := uint64(1); i <= 2; i++ {
+		if data, err := w.Read(i); err == nil {
+			t.Error(i, string(data))
+		}
+	}
+	w.Close()
+	os.RemoveAll(file)
+}
@@ -0,0 +1,158 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"bufio"
+	"path/filepath"
+)
+
+// WriteKey writes an entry with the key to buffer. A nil value writes a
+// tombstone of the key, which makes Compact remove the entries of the key before it.
+func (w *WAL) WriteKey(index uint64, key, value []byte) (err error) {
+	if key == nil {
+		key = []byte{}
+	}
+	w.mu.Lock()
+	err = w.write(index, value, &meta{key: key, tombstone: value == nil})
+	w.mu.Unlock()
+	return
+}
+
+// ReadKey returns the key and the value by index. The key of an entry written
+// without a key is nil, and the value of a tombstone is nil.
+func (w *WAL) ReadKey(index uint64) (key, value []byte, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var m meta
+	if value, err = w.read(index, &m); err != nil {
+		return nil, nil, err
+	}
+	if m.tombstone {
+		value = nil
+	} else if value == nil {
+		value = []byte{}
+	}
+	return m.key, value, nil
+}
+
+// Compact rewrites the sealed segments whose entries are all before upTo,
+// keeping only the newest entry of each key before upTo. The entries without
+// a key are kept, and so is a tombstone if it is the newest. A removed entry is replaced by a
+// placeholder, so the indexes do not change and Read of it returns ErrCompacted.
+// Each segment is rewritten to a temporary file, which is synced and renamed
+// to the segment. The keys of an encrypted log are decrypted to compact it.
+func (w *WAL) Compact(upTo uint64) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	if err = w.flush(); err != nil {
+		return err
+	}
+	newest := make(map[string]uint64)
+	var segments []*segment
+	for i, s := range w.segments {
+		if s.offset+1 >= upTo {
+			break
+		}
+		if err = w.loadSegment(s); err != nil {
+			return err
+		}
+		if i < len(w.segments)-1 && s.offset+s.len < upTo {
+			segments = append(segments, s)
+		}
+		for index := s.offset + 1; index <= s.offset+s.len && index < upTo; index++ {
+			entryData, err := s.readRecord(index)
+			if err != nil {
+				return err
+			}
+			var m meta
+			if err = w.recordMeta(index, entryData, &m); err != nil {
+				return err
+			}
+			if m.key != nil && !m.compacted {
+				newest[string(m.key)] = index
+			}
+		}
+	}
+	for _, s := range segments {
+		if err = w.compactSegment(s, newest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// compactSegment rewrites the segment with placeholders of the entries that
+// are not the newest of their keys.
+func (w *WAL) compactSegment(s *segment, newest map[string]uint64) (err error) {
+	tmpName := filepath.Join(w.path, tmpfile)
+	tmpFile, err := w.fs.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			tmpFile.Close()
+			w.fs.Remove(tmpName)
+		}
+	}()
+	buf := bufio.NewWriter(tmpFile)
+	var placeholder []byte
+	compacted := false
+	for index := s.offset + 1; index <= s.offset+s.len; index++ {
+		entryData, err := s.readRecord(index)
+		if err != nil {
+			return err
+		}
+		var m meta
+		if err = w.recordMeta(index, entryData, &m); err != nil {
+			return err
+		}
+		if m.key != nil && !m.compacted && newest[string(m.key)] != index {
+			placeholder = appendPlaceholder(placeholder[:0], &m)
+			entryData = placeholder
+			compacted = true
+		}
+		if _, err = buf.Write(entryData); err != nil {
+			return err
+		}
+	}
+	if !compacted {
+		tmpFile.Close()
+		return w.fs.Remove(tmpName)
+	}
+	if err = buf.Flush(); err != nil {
+		return err
+	}
+	if err = tmpFile.Sync(); err != nil {
+		return err
+	}
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+	if err = s.close(); err != nil {
+		return err
+	}
+	if err = w.fs.Rename(tmpName, s.logPath); err != nil {
+		return err
+	}
+	s.times = nil
+	return s.load()
+}
+
+// recordMeta decodes the fields of the record at index to the meta, and
+// decrypts the key if it is encrypted with the entry.
+func (w *WAL) recordMeta(index uint64, entryData []byte, m *meta) error {
+	flags, _, _, err := decodeFields(entryData, m)
+	if err != nil {
+		return err
+	}
+	if flags&flagKey != 0 && flags&flagEncrypted != 0 {
+		_, err = w.decode(index, entryData, m)
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCompact(t *testing.T) {
+	file := "wal"
+	os.RemoveAll(file)
+	keys := &testKeys{current: 1, keys: map[uint64][]byte{1: bytes.Repeat([]byte{1}, 16)}}
+	opts := &Options{SegmentEntries: 4, RecordTime: true, Cipher: NewCipher(keys)}
+	w, err := Open(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	type kv struct {
+		key, value string
+		tombstone  bool
+	}
+	entries := []kv{
+		{"k1", "a1", false}, {"k2", "b1", false}, {"", "p3", false}, {"k1", "a2", false},
+		{"k3", "c1", false}, {"k2", "", true}, {"k1", "a3", false}, {"", "p8", false},
+		{"k3", "c2", false}, {"k1", "a4", false}, {"", "p11", false}, {"", "p12", false},
+		{"k2", "b2", false}, {"", "p14", false},
+	}
+	times := make([]time.Time, len(entries)+1)
+	for i, e := range entries {
+		index := uint64(i + 1)
+		times[index] = time.Now()
+		if e.key == "" {
+			w.Write(index, []byte(e.value))
+		} else if e.tombstone {
+			w.WriteKey(index, []byte(e.key), nil)
+		} else {
+			w.WriteKey(index, []byte(e.key), []byte(e.value))
+		}
+		time.Sleep(time.Microsecond)
+	}
+	check := func(compacted ...uint64) {
+		removed := make(map[uint64]bool)
+		for _, index := range compacted {
+			removed[index] = true
+		}
+		for i, e := range entries {
+			index := uint64(i + 1)
+			key, value, err := w.ReadKey(index)
+			if removed[index] {
+				if err != ErrCompacted {
+					t.Error(index, err)
+				}
+				if _, err = w.Read(index); err != ErrCompacted {
+					t.Error(index, err)
+				}
+			} else if err != nil {
+				t.Error(index, err)
+			} else if e.key == "" && key != nil || string(key) != e.key {
+				t.Error(index, key)
+			} else if e.tombstone && value != nil || string(value) != e.value {
+				t.Error(index, value)
+			}
+			if at, err := w.IndexAt(times[index]); err != nil || at != index {
+				t.Error(index, at, err)
+			}
+		}
+		var n int
+		err := w.ReplayCommitted(1, func(index uint64, data []byte) error {
+			n++
+			if removed[index] {
+				t.Error(index)
+			}
+			return nil
+		})
+		if err != nil || n != len(entries)-len(compacted) {
+			t.Error(n, err)
+		}
+	}
+	check()
+	if err = w.Compact(9); err != nil {
+		t.Error(err)
+	}
+	check(1, 2, 4)
+	w.Close()
+	w, err = Open(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	check(1, 2, 4)
+	if err = w.Compact(14); err != nil {
+		t.Error(err)
+	}
+	check(1, 2, 4, 5, 6, 7)
+	if err = w.Compact(100); err != nil {
+		t.Error(err)
+	}
+	check(1, 2, 4, 5, 6, 7)
+	if err = w.Clean(3); err != nil {
+		t.Error(err)
+	}
+	if err = w.Truncate(10); err != nil {
+		t.Error(err)
+	}
+	if _, err = w.Read(4); err != ErrCompacted {
+		t.Error(err)
+	}
+	if _, value, err := w.ReadKey(10); err != nil || string(value) != "a4" {
+		t.Error(value, err)
+	}
+	w.Close()
+	os.RemoveAll(file)
+}
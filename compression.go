@@ -0,0 +1,72 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"sync"
+)
+
+const (
+	// FlateCodecID is the codec id of the flate codec.
+	FlateCodecID = 1
+)
+
+// Codec represents a compression codec of entries.
+type Codec interface {
+	// ID returns the codec id stored in each compressed record.
+	ID() uint8
+	// Encode appends the compressed src to dst and returns the result.
+	Encode(dst, src []byte) ([]byte, error)
+	// Decode appends the decompressed src to dst and returns the result.
+	Decode(dst, src []byte) ([]byte, error)
+}
+
+type flateCodec struct {
+	level   int
+	writers sync.Pool
+}
+
+// NewFlateCodec returns a new codec by the compress/flate package with the given level.
+func NewFlateCodec(level int) Codec {
+	return &flateCodec{level: level}
+}
+
+func (c *flateCodec) ID() uint8 {
+	return FlateCodecID
+}
+
+func (c *flateCodec) Encode(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	var fw *flate.Writer
+	if v := c.writers.Get(); v != nil {
+		fw = v.(*flate.Writer)
+		fw.Reset(buf)
+	} else {
+		var err error
+		if fw, err = flate.NewWriter(buf, c.level); err != nil {
+			return nil, err
+		}
+	}
+	defer c.writers.Put(fw)
+	if _, err := fw.Write(src); err != nil {
+		return nil, err
+	}
+	if err := fw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (c *flateCodec) Decode(dst, src []byte) ([]byte, error) {
+	buf := bytes.NewBuffer(dst)
+	fr := flate.NewReader(bytes.NewReader(src))
+	defer fr.Close()
+	if _, err := io.Copy(buf, fr); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
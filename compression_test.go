@@ -0,0 +1,126 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"os"
+	"testing"
+)
+
+func TestCompression(t *testing.T) {
+	file := "wal"
+	os.RemoveAll(file)
+	opts := &Options{SegmentEntries: 4, Compression: NewFlateCodec(flate.BestSpeed), CompressionThreshold: 64}
+	w, err := Open(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	entry := func(i uint64) []byte {
+		if i%2 == 0 {
+			return []byte{byte(i)}
+		}
+		return bytes.Repeat([]byte{byte(i)}, 1024)
+	}
+	for i := uint64(1); i <= 10; i++ {
+		if err = w.Write(i, entry(i)); err != nil {
+			t.Error(err)
+		}
+	}
+	w.Flush()
+	if info, err := os.Stat(w.segments[0].logPath); err != nil {
+		t.Error(err)
+	} else if info.Size() >= 1024 {
+		t.Error(info.Size())
+	}
+	for i := uint64(1); i <= 10; i++ {
+		if data, err := w.Read(i); err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(data, entry(i)) {
+			t.Error(i, data)
+		}
+	}
+	if err = w.Clean(3); err != nil {
+		t.Error(err)
+	}
+	if err = w.Truncate(9); err != nil {
+		t.Error(err)
+	}
+	w.Close()
+	w, err = Open(file, &Options{SegmentEntries: 4})
+	if err != nil {
+		t.Error(err)
+	}
+	if err = w.Write(10, entry(10)); err != nil {
+		t.Error(err)
+	}
+	w.Flush()
+	for i := uint64(3); i <= 10; i++ {
+		if data, err := w.Read(i); err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(data, entry(i)) {
+			t.Error(i, data)
+		}
+	}
+	w.Close()
+	os.RemoveAll(file)
+}
+
+type testCodec struct{}
+
+func (testCodec) ID() uint8 { return 9 }
+
+func (testCodec) Encode(dst, src []byte) ([]byte, error) {
+	return append(dst, src[:len(src)/2]...), nil
+}
+
+func (testCodec) Decode(dst, src []byte) ([]byte, error) {
+	return append(append(dst, src...), src...), nil
+}
+
+func TestCompressionCodec(t *testing.T) {
+	file := "wal"
+	os.RemoveAll(file)
+	w, err := Open(file, &Options{Compression: testCodec{}, SegmentEntries: 4})
+	if err != nil {
+		t.Error(err)
+	}
+	data := bytes.Repeat([]byte{1}, 512)
+	w.Write(1, data)
+	w.Flush()
+	if b, err := w.Read(1); err != nil {
+		t.Error(err)
+	} else if !bytes.Equal(b, data) {
+		t.Error(b)
+	}
+	w.Close()
+	w, err = Open(file, &Options{SegmentEntries: 4})
+	if err != nil {
+		t.Error(err)
+	}
+	if _, err := w.Read(1); err != ErrUnknownCodec {
+		t.Error(err)
+	}
+	w.Close()
+	os.RemoveAll(file)
+}
+
+func BenchmarkWalWriteCompression(b *testing.B) {
+	file := "wal"
+	os.RemoveAll(file)
+	w, err := Open(file, &Options{Compression: NewFlateCodec(flate.BestSpeed)})
+	if err != nil {
+		b.Error(err)
+	}
+	data := bytes.Repeat([]byte("Hello World"), 64)
+	var index uint64
+	for i := 0; i < b.N; i++ {
+		index++
+		w.Write(index, data)
+		w.Flush()
+	}
+	w.Close()
+	os.RemoveAll(file)
+}
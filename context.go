@@ -0,0 +1,134 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"context"
+)
+
+// WriteContext is like Write, but returns ErrCanceled without writing
+// when the context is done before the entry is written, including while
+// waiting for another operation on the log.
+func (w *WAL) WriteContext(ctx context.Context, index uint64, data []byte) (err error) {
+	if err = checkContext(ctx); err != nil {
+		return err
+	}
+	if err = w.mu.lockContext(ctx); err != nil {
+		return err
+	}
+	defer w.mu.Unlock()
+	if err = checkContext(ctx); err != nil {
+		return err
+	}
+	return w.write(index, data, nil)
+}
+
+// FlushContext is like Flush, but returns ErrCanceled without flushing
+// when the context is done before the write buffer is written.
+func (w *WAL) FlushContext(ctx context.Context) (err error) {
+	if err = checkContext(ctx); err != nil {
+		return err
+	}
+	if err = w.mu.lockContext(ctx); err != nil {
+		return err
+	}
+	defer w.mu.Unlock()
+	if err = checkContext(ctx); err != nil {
+		return err
+	}
+	return w.flush()
+}
+
+// SyncContext is like Sync, but returns ErrCanceled when the context is done
+// before the file is synced. A sync in progress is not interrupted.
+func (w *WAL) SyncContext(ctx context.Context) (err error) {
+	if err = checkContext(ctx); err != nil {
+		return err
+	}
+	if err = w.mu.lockContext(ctx); err != nil {
+		return err
+	}
+	defer w.mu.Unlock()
+	if err = checkContext(ctx); err != nil {
+		return err
+	}
+	if err = w.flush(); err != nil {
+		return err
+	}
+	if err = checkContext(ctx); err != nil {
+		return err
+	}
+	return w.sync()
+}
+
+// CleanContext is like Clean, but returns ErrCanceled when the context is done
+// before the old entries are cleaned. A canceled clean discards the partial copy
+// of the segment and leaves the log unchanged.
+func (w *WAL) CleanContext(ctx context.Context, index uint64) (err error) {
+	if err = checkContext(ctx); err != nil {
+		return err
+	}
+	if err = w.mu.lockContext(ctx); err != nil {
+		return err
+	}
+	defer w.mu.Unlock()
+	if err = checkContext(ctx); err != nil {
+		return err
+	}
+	return w.clean(ctx, index)
+}
+
+// TruncateContext is like Truncate, but returns ErrCanceled when the context is done
+// before the dirty entries are deleted. A canceled truncate discards the partial copy
+// of the segment and leaves the log unchanged.
+func (w *WAL) TruncateContext(ctx context.Context, index uint64) (err error) {
+	if err = checkContext(ctx); err != nil {
+		return err
+	}
+	if err = w.mu.lockContext(ctx); err != nil {
+		return err
+	}
+	defer w.mu.Unlock()
+	if err = checkContext(ctx); err != nil {
+		return err
+	}
+	return w.truncate(ctx, index)
+}
+
+// mutex is a mutual exclusion lock of a channel semaphore, so that
+// waiting for the lock can be canceled by a context.
+type mutex chan struct{}
+
+func newMutex() mutex {
+	return make(mutex, 1)
+}
+
+// Lock locks the mutex.
+func (m mutex) Lock() {
+	m <- struct{}{}
+}
+
+// Unlock unlocks the mutex.
+func (m mutex) Unlock() {
+	<-m
+}
+
+// lockContext locks the mutex, or returns ErrCanceled if the context is done
+// while waiting for the lock.
+func (m mutex) lockContext(ctx context.Context) error {
+	select {
+	case m <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ErrCanceled
+	}
+}
+
+// checkContext returns ErrCanceled if the context is done.
+func checkContext(ctx context.Context) error {
+	if ctx.Err() != nil {
+		return ErrCanceled
+	}
+	return nil
+}
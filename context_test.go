@@ -0,0 +1,105 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// countdownContext is done after its Err method has been called n times.
+type countdownContext struct {
+	context.Context
+	n int
+}
+
+func (c *countdownContext) Err() error {
+	if c.n <= 0 {
+		return context.Canceled
+	}
+	c.n--
+	return nil
+}
+
+func TestContext(t *testing.T) {
+	file := "wal"
+	os.RemoveAll(file)
+	w, err := Open(file, &Options{SegmentEntries: 4})
+	if err != nil {
+		t.Error(err)
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err = w.WriteContext(canceled, 1, []byte("entry-1")); err != ErrCanceled {
+		t.Error(err)
+	}
+	for i := uint64(1); i <= 10; i++ {
+		if err = w.WriteContext(context.Background(), i, []byte(fmt.Sprintf("entry-%d", i))); err != nil {
+			t.Error(err)
+		}
+	}
+	if err = w.FlushContext(canceled); err != ErrCanceled {
+		t.Error(err)
+	}
+	if err = w.SyncContext(canceled); err != ErrCanceled {
+		t.Error(err)
+	}
+	if err = w.SyncContext(context.Background()); err != nil {
+		t.Error(err)
+	}
+	// canceled in the copy of the segment
+	if err = w.CleanContext(&countdownContext{Context: context.Background(), n: 2}, 6); err != ErrCanceled {
+		t.Error(err)
+	}
+	if err = w.TruncateContext(&countdownContext{Context: context.Background(), n: 2}, 7); err != ErrCanceled {
+		t.Error(err)
+	}
+	if _, err = os.Stat(filepath.Join(file, tmpfile)); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+	check := func(first, last uint64) {
+		if index, _ := w.FirstIndex(); index != first {
+			t.Error(index, first)
+		}
+		if index, _ := w.LastIndex(); index != last {
+			t.Error(index, last)
+		}
+		for i := first; i <= last; i++ {
+			if data, err := w.Read(i); err != nil || string(data) != fmt.Sprintf("entry-%d", i) {
+				t.Error(i, string(data), err)
+			}
+		}
+	}
+	check(1, 10)
+	// canceled while waiting for the lock
+	w.mu.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	if err = w.WriteContext(ctx, 11, []byte("entry-11")); err != ErrCanceled {
+		t.Error(err)
+	}
+	if err = w.TruncateContext(ctx, 7); err != ErrCanceled {
+		t.Error(err)
+	}
+	cancel()
+	w.mu.Unlock()
+	check(1, 10)
+	w.Close()
+	if w, err = Open(file, &Options{SegmentEntries: 4}); err != nil {
+		t.Error(err)
+	}
+	check(1, 10)
+	if err = w.CleanContext(context.Background(), 6); err != nil {
+		t.Error(err)
+	}
+	if err = w.TruncateContext(context.Background(), 7); err != nil {
+		t.Error(err)
+	}
+	check(6, 7)
+	w.Close()
+	os.RemoveAll(file)
+}
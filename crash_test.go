@@ -0,0 +1,640 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/hslam/mmap"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var errCrash = errors.New("crash")
+
+// faultFS is a file system that crashes at the crashAt-th I/O call. After a
+// crash every call fails, and restore discards the data that was not synced
+// except a part of the data appended to a file, chosen by keep.
+// The creations, renames and removals of files are not durable until their
+// directory is synced, and restore rolls them back to the last sync.
+// Truncating a file is treated as durable. The file system starts empty.
+type faultFS struct {
+	calls   int
+	crashAt int
+	keep    int
+	crashed bool
+	// appended reports whether restore found unsynced appended data.
+	appended bool
+	names    map[string]*faultInode
+	synced   map[string]*faultInode
+	files    []*faultFile
+}
+
+// faultInode is the synced data of a file.
+type faultInode struct {
+	data []byte
+}
+
+const (
+	// keepNone discards all data appended after the last sync.
+	keepNone = iota
+	// keepRecords keeps the first half of the complete records appended.
+	keepRecords
+	// keepHalf keeps the first half of the bytes appended, which usually
+	// ends in the middle of a record.
+	keepHalf
+	// keepAll keeps all bytes appended, which may end in the middle of a
+	// record written by WriteFrom.
+	keepAll
+	keepModes
+)
+
+func newFaultFS(crashAt, keep int) *faultFS {
+	return &faultFS{
+		crashAt: crashAt,
+		keep:    keep,
+		names:   make(map[string]*faultInode),
+		synced:  make(map[string]*faultInode),
+	}
+}
+
+func (fs *faultFS) step() error {
+	if fs.crashed {
+		return errCrash
+	}
+	fs.calls++
+	if fs.calls == fs.crashAt {
+		fs.crashed = true
+		return errCrash
+	}
+	return nil
+}
+
+func (fs *faultFS) open(f *os.File, err error, trunc bool) (file, error) {
+	if err != nil {
+		return nil, err
+	}
+	ino, ok := fs.names[f.Name()]
+	if !ok {
+		ino = &faultInode{data: []byte{}}
+		fs.names[f.Name()] = ino
+	} else if trunc {
+		ino.data = []byte{}
+	}
+	ff := &faultFile{File: f, fs: fs, name: f.Name(), ino: ino}
+	fs.files = append(fs.files, ff)
+	return ff, nil
+}
+
+// unlink detaches the open files from the name.
+func (fs *faultFS) unlink(name string) {
+	for _, f := range fs.files {
+		if f.name == name {
+			f.name = ""
+		}
+	}
+}
+
+func (fs *faultFS) Create(name string) (file, error) {
+	if err := fs.step(); err != nil {
+		return nil, err
+	}
+	f, err := os.Create(name)
+	return fs.open(f, err, true)
+}
+
+func (fs *faultFS) Open(name string) (file, error) {
+	if err := fs.step(); err != nil {
+		return nil, err
+	}
+	f, err := os.Open(name)
+	return fs.open(f, err, false)
+}
+
+func (fs *faultFS) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	if err := fs.step(); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(name, flag, perm)
+	return fs.open(f, err, flag&os.O_TRUNC != 0)
+}
+
+func (fs *faultFS) Remove(name string) error {
+	if err := fs.step(); err != nil {
+		return err
+	}
+	if err := os.Remove(name); err != nil {
+		return err
+	}
+	delete(fs.names, name)
+	fs.unlink(name)
+	return nil
+}
+
+func (fs *faultFS) Rename(oldpath, newpath string) error {
+	if err := fs.step(); err != nil {
+		return err
+	}
+	if err := os.Rename(oldpath, newpath); err != nil {
+		return err
+	}
+	fs.unlink(newpath)
+	if ino, ok := fs.names[oldpath]; ok {
+		fs.names[newpath] = ino
+		delete(fs.names, oldpath)
+	}
+	for _, f := range fs.files {
+		if f.name == oldpath {
+			f.name = newpath
+		}
+	}
+	return nil
+}
+
+func (fs *faultFS) Link(oldname, newname string) error {
+	if err := fs.step(); err != nil {
+		return err
+	}
+	if err := os.Link(oldname, newname); err != nil {
+		return err
+	}
+	if ino, ok := fs.names[oldname]; ok {
+		fs.names[newname] = ino
+	}
+	return nil
+}
+
+func (fs *faultFS) MkdirAll(path string, perm os.FileMode) error {
+	if err := fs.step(); err != nil {
+		return err
+	}
+	return os.MkdirAll(path, perm)
+}
+
+func (fs *faultFS) Stat(name string) (os.FileInfo, error) {
+	if err := fs.step(); err != nil {
+		return nil, err
+	}
+	return os.Stat(name)
+}
+
+func (fs *faultFS) SyncDir(dir string) error {
+	if err := fs.step(); err != nil {
+		return err
+	}
+	dir = filepath.Clean(dir)
+	for name := range fs.synced {
+		if filepath.Dir(name) == dir {
+			delete(fs.synced, name)
+		}
+	}
+	for name, ino := range fs.names {
+		if filepath.Dir(name) == dir {
+			fs.synced[name] = ino
+		}
+	}
+	return nil
+}
+
+// restore closes all files, rolls the directories back to their synced
+// entries, and rolls every file back to its synced content followed by
+// the part of the appended data to keep.
+func (fs *faultFS) restore() error {
+	for _, f := range fs.files {
+		f.File.Close()
+	}
+	fs.files = nil
+	appended := make(map[string][]byte)
+	for name, ino := range fs.synced {
+		if fs.names[name] != ino {
+			continue
+		}
+		data, err := ioutil.ReadFile(name)
+		if err != nil {
+			return err
+		}
+		if len(data) > len(ino.data) && bytes.HasPrefix(data, ino.data) {
+			appended[name] = data[len(ino.data):]
+			fs.appended = true
+		}
+	}
+	for name := range fs.names {
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	for name, ino := range fs.synced {
+		data := append(ino.data[:len(ino.data):len(ino.data)], fs.keepAppended(appended[name])...)
+		if err := ioutil.WriteFile(name, data, 0666); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// keepAppended returns the part of the appended data to keep.
+func (fs *faultFS) keepAppended(data []byte) []byte {
+	switch fs.keep {
+	case keepRecords:
+		var ends []int
+		for end := 0; end < len(data); {
+			n := recordLength(data[end:])
+			if n == 0 {
+				break
+			}
+			end += n
+			ends = append(ends, end)
+		}
+		if len(ends) < 2 {
+			return nil
+		}
+		return data[:ends[len(ends)/2-1]]
+	case keepHalf:
+		return data[:len(data)/2]
+	case keepAll:
+		return data
+	}
+	return nil
+}
+
+type faultFile struct {
+	*os.File
+	fs   *faultFS
+	name string
+	ino  *faultInode
+}
+
+func (f *faultFile) Read(p []byte) (int, error) {
+	if err := f.fs.step(); err != nil {
+		return 0, err
+	}
+	return f.File.Read(p)
+}
+
+func (f *faultFile) Write(p []byte) (int, error) {
+	if err := f.fs.step(); err != nil {
+		return 0, err
+	}
+	return f.File.Write(p)
+}
+
+// ReadFrom writes the data read from r in small chunks by Write, so that
+// a crash may happen in the middle of an entry.
+func (f *faultFile) ReadFrom(r io.Reader) (int64, error) {
+	return io.CopyBuffer(struct{ io.Writer }{f}, r, make([]byte, 8))
+}
+
+func (f *faultFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.fs.step(); err != nil {
+		return 0, err
+	}
+	return f.File.ReadAt(p, off)
+}
+
+func (f *faultFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.fs.step(); err != nil {
+		return 0, err
+	}
+	return f.File.Seek(offset, whence)
+}
+
+func (f *faultFile) Stat() (os.FileInfo, error) {
+	if err := f.fs.step(); err != nil {
+		return nil, err
+	}
+	return f.File.Stat()
+}
+
+func (f *faultFile) Truncate(size int64) error {
+	if err := f.fs.step(); err != nil {
+		return err
+	}
+	return f.File.Truncate(size)
+}
+
+func (f *faultFile) Sync() error {
+	if err := f.fs.step(); err != nil {
+		return err
+	}
+	// The synced data is kept by the model instead of the disk.
+	if f.name == "" {
+		// The file has been removed or replaced.
+		return nil
+	}
+	data, err := ioutil.ReadFile(f.name)
+	if err != nil {
+		return err
+	}
+	f.ino.data = data
+	return nil
+}
+
+func (f *faultFile) Close() error {
+	if err := f.fs.step(); err != nil {
+		return err
+	}
+	return f.File.Close()
+}
+
+const (
+	crashWrite = iota
+	crashWriteFrom
+	crashFlush
+	crashSync
+	crashRead
+	crashClean
+	crashTruncate
+	crashResetTo
+)
+
+type crashOp struct {
+	kind  int
+	index uint64
+}
+
+// crashModel is the reference model of a write-ahead log.
+type crashModel struct {
+	first   uint64
+	clean   uint64
+	last    uint64
+	flushed uint64
+	durable uint64
+	gen     int
+	data    map[uint64][]byte
+}
+
+func newCrashModel() *crashModel {
+	return &crashModel{data: make(map[uint64][]byte)}
+}
+
+func (m *crashModel) clone() *crashModel {
+	c := *m
+	c.data = make(map[uint64][]byte, len(m.data))
+	for k, v := range m.data {
+		c.data[k] = v
+	}
+	return &c
+}
+
+func min(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// exec runs the operation on the log.
+func (m *crashModel) exec(w *WAL, op crashOp) error {
+	switch op.kind {
+	case crashWrite:
+		return w.Write(m.last+1, m.entry(m.last+1))
+	case crashWriteFrom:
+		data := m.entry(m.last + 1)
+		return w.WriteFrom(m.last+1, bytes.NewReader(data), int64(len(data)))
+	case crashFlush:
+		return w.Flush()
+	case crashSync:
+		return w.Sync()
+	case crashRead:
+		data, err := w.Read(op.index)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(data, m.data[op.index]) {
+			return fmt.Errorf("read %d: %q != %q", op.index, data, m.data[op.index])
+		}
+	case crashClean:
+		return w.Clean(op.index)
+	case crashTruncate:
+		return w.Truncate(op.index)
+	case crashResetTo:
+		return w.ResetTo(op.index)
+	}
+	return nil
+}
+
+func (m *crashModel) entry(index uint64) []byte {
+	return []byte(fmt.Sprintf("entry-%d-%d", index, m.gen))
+}
+
+// update applies the operation to the model.
+func (m *crashModel) update(op crashOp) {
+	switch op.kind {
+	case crashWrite, crashWriteFrom:
+		index := m.last + 1
+		if m.first == 0 {
+			m.first = index
+			m.clean = index
+		}
+		m.data[index] = m.entry(index)
+		m.last = index
+		if op.kind == crashWriteFrom {
+			// WriteFrom flushes the buffer and writes the entry to the file.
+			m.flushed = index
+		}
+	case crashFlush:
+		m.flushed = m.last
+	case crashSync:
+		m.durable = m.flushed
+	case crashClean:
+		m.clean = op.index
+	case crashTruncate:
+		for i := op.index + 1; i <= m.last; i++ {
+			delete(m.data, i)
+		}
+		m.last = op.index
+		m.flushed = min(m.flushed, op.index)
+		m.durable = min(m.durable, op.index)
+		m.gen++
+	case crashResetTo:
+		m.data = make(map[uint64][]byte)
+		m.first = op.index
+		m.clean = op.index
+		m.last = op.index - 1
+		m.flushed = m.last
+		m.durable = m.last
+		m.gen++
+	}
+}
+
+// verify checks that the recovered log is a state allowed by the model
+// with the first index in [minFirst, maxFirst].
+func (m *crashModel) verify(w *WAL, minFirst, maxFirst uint64) error {
+	first, err := w.FirstIndex()
+	if err != nil {
+		return err
+	}
+	last, err := w.LastIndex()
+	if err != nil {
+		return err
+	}
+	if last < m.durable || last > m.last {
+		return fmt.Errorf("last index %d not in [%d, %d]", last, m.durable, m.last)
+	}
+	if last == 0 || last < first {
+		return nil
+	}
+	if first < minFirst || first > maxFirst {
+		return fmt.Errorf("first index %d not in [%d, %d]", first, minFirst, maxFirst)
+	}
+	for i := first; i <= last; i++ {
+		data, err := w.Read(i)
+		if err != nil {
+			return fmt.Errorf("read %d: %v", i, err)
+		}
+		if !bytes.Equal(data, m.data[i]) {
+			return fmt.Errorf("read %d: %q != %q", i, data, m.data[i])
+		}
+	}
+	return nil
+}
+
+func crashWorkload() []crashOp {
+	var ops []crashOp
+	write := func(n int) {
+		for i := 0; i < n; i++ {
+			ops = append(ops, crashOp{kind: crashWrite})
+		}
+	}
+	writeFrom := func(n int) {
+		for i := 0; i < n; i++ {
+			ops = append(ops, crashOp{kind: crashWriteFrom})
+		}
+	}
+	commit := func() {
+		ops = append(ops, crashOp{kind: crashFlush}, crashOp{kind: crashSync})
+	}
+	write(1)
+	commit()
+	write(4)
+	writeFrom(2)
+	ops = append(ops, crashOp{kind: crashFlush})
+	write(2)
+	commit()
+	ops = append(ops, crashOp{kind: crashRead, index: 2})
+	ops = append(ops, crashOp{kind: crashClean, index: 3})
+	write(3)
+	ops = append(ops, crashOp{kind: crashClean, index: 6})
+	write(2)
+	commit()
+	ops = append(ops, crashOp{kind: crashTruncate, index: 10})
+	write(4)
+	ops = append(ops, crashOp{kind: crashTruncate, index: 12})
+	write(2)
+	commit()
+	ops = append(ops, crashOp{kind: crashRead, index: 7})
+	ops = append(ops, crashOp{kind: crashClean, index: 13})
+	write(1)
+	commit()
+	ops = append(ops, crashOp{kind: crashTruncate, index: 14})
+	write(3)
+	ops = append(ops, crashOp{kind: crashClean, index: 15})
+	commit()
+	ops = append(ops, crashOp{kind: crashResetTo, index: 30})
+	writeFrom(2)
+	write(3)
+	commit()
+	ops = append(ops, crashOp{kind: crashResetTo, index: 20})
+	write(3)
+	commit()
+	return ops
+}
+
+// runCrash runs the workload and crashes at the crashAt-th I/O call.
+// It returns the fault file system.
+func runCrash(t *testing.T, path string, opts Options, crashAt, keep int) *faultFS {
+	os.RemoveAll(path)
+	fs := newFaultFS(crashAt, keep)
+	opts.fs = fs
+	ops := crashWorkload()
+	before := newCrashModel()
+	after := before
+	w, err := Open(path, &opts)
+	if err == nil {
+		for _, op := range ops {
+			before = after.clone()
+			err = after.exec(w, op)
+			after.update(op)
+			if fs.crashed {
+				break
+			} else if err != nil {
+				t.Fatalf("crash at %d: %v", crashAt, err)
+			}
+		}
+	}
+	if !fs.crashed {
+		if err != nil {
+			t.Fatalf("open: %v", err)
+		}
+		calls := fs.calls
+		minFirst := after.clean
+		if opts.NoSplitSegment {
+			minFirst = after.first
+		}
+		if err = after.verify(w, minFirst, after.clean); err != nil {
+			t.Fatalf("no crash: %v", err)
+		}
+		w.Close()
+		// The I/O calls of verify are not counted.
+		fs.calls = calls
+		return fs
+	}
+	if w != nil {
+		for _, s := range w.segments {
+			if len(s.indexMmap) > 0 {
+				mmap.Munmap(s.indexMmap)
+			}
+		}
+	}
+	if err = fs.restore(); err != nil {
+		t.Fatal(err)
+	}
+	opts.fs = nil
+	w, err = Open(path, &opts)
+	if err != nil {
+		t.Fatalf("crash at %d: reopen: %v", crashAt, err)
+	}
+	defer w.Close()
+	minFirst, maxFirst := before.clean, after.clean
+	if opts.NoSplitSegment {
+		minFirst = before.first
+	}
+	if maxFirst < minFirst {
+		// ResetTo moves the first index backwards.
+		minFirst, maxFirst = maxFirst, minFirst
+	}
+	if err = before.verify(w, minFirst, maxFirst); err != nil {
+		if err2 := after.verify(w, minFirst, maxFirst); err2 != nil {
+			t.Fatalf("crash at %d: %v; %v", crashAt, err, err2)
+		}
+	}
+	return fs
+}
+
+func TestCrash(t *testing.T) {
+	path := "wal"
+	for _, opts := range []Options{
+		{SegmentEntries: 4},
+		{SegmentEntries: 4, NoSplitSegment: true},
+		{SegmentSize: 64, SegmentEntries: 16},
+	} {
+		calls := runCrash(t, path, opts, 0, keepNone).calls
+		for i := 1; i <= calls; i++ {
+			for keep := keepNone; keep < keepModes; keep++ {
+				fs := runCrash(t, path, opts, i, keep)
+				if !fs.crashed {
+					t.Fatalf("no crash at %d", i)
+				} else if !fs.appended {
+					// The other modes restore the same files.
+					break
+				}
+			}
+		}
+	}
+	os.RemoveAll(path)
+}
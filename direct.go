@@ -0,0 +1,96 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"unsafe"
+)
+
+// directBlockSize is the block size of direct I/O. The offset, the length and
+// the memory address of a direct write are aligned to it.
+const directBlockSize = 4096
+
+func alignUp(n int) int {
+	return (n + directBlockSize - 1) &^ (directBlockSize - 1)
+}
+
+func alignDown(n int) int {
+	return n &^ (directBlockSize - 1)
+}
+
+// alignedBuffer returns a buffer whose memory address is aligned to the block size.
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+directBlockSize)
+	shift := int(uintptr(unsafe.Pointer(&buf[0])) & (directBlockSize - 1))
+	if shift > 0 {
+		shift = directBlockSize - shift
+	}
+	return buf[shift : shift+size : shift+size]
+}
+
+// openTail prepares the active segment for writing. With direct I/O, it opens
+// the segment with O_DIRECT, and reads the partial last block into the write
+// buffer to be rewritten. Otherwise, it removes the padding of direct I/O.
+func (w *WAL) openTail(s *segment) (err error) {
+	end := s.end()
+	w.writeBuffer = w.writeBuffer[:0]
+	w.tail = 0
+	if w.directIO {
+		if s.directFile, err = openDirect(w.fs, s.logPath, w.logFlag(), w.fileMode); err == nil {
+			start := alignDown(int(end))
+			w.directOffset = int64(start)
+			w.reserve(int(end) - start)
+			w.writeBuffer = w.writeBuffer[:int(end)-start]
+			if _, err = s.logFile.ReadAt(w.writeBuffer, int64(start)); err != nil {
+				w.writeBuffer = w.writeBuffer[:0]
+				return err
+			}
+			w.tail = len(w.writeBuffer)
+			return nil
+		}
+		// The file system does not support direct I/O.
+		w.directIO = false
+	}
+	size, err := fsize(s.logFile)
+	if err != nil {
+		return err
+	}
+	if int64(size) > end {
+		return s.logFile.Truncate(end)
+	}
+	return nil
+}
+
+// reserve grows the aligned write buffer for n more bytes and the padding.
+func (w *WAL) reserve(n int) {
+	size := alignUp(len(w.writeBuffer) + n + paddingHeaderSize)
+	if size <= cap(w.writeBuffer) {
+		return
+	}
+	if size < cap(w.writeBuffer)*2 {
+		size = cap(w.writeBuffer) * 2
+	}
+	buf := alignedBuffer(size)[:len(w.writeBuffer)]
+	copy(buf, w.writeBuffer)
+	w.writeBuffer = buf
+}
+
+// flushDirect writes the write buffer in aligned blocks with a padding record
+// in the last block, and keeps the partial last block in the write buffer.
+func (w *WAL) flushDirect() (err error) {
+	n := len(w.writeBuffer)
+	buf := w.writeBuffer[:alignUp(n+paddingHeaderSize)]
+	appendPadding(buf[n:])
+	if _, err = w.lastSegment.directFile.WriteAt(buf, w.directOffset); err != nil {
+		return err
+	}
+	if w.budget != nil {
+		w.budget.release(n - w.tail)
+	}
+	start := alignDown(n)
+	w.tail = copy(w.writeBuffer, w.writeBuffer[start:n])
+	w.writeBuffer = w.writeBuffer[:w.tail]
+	w.directOffset += int64(start)
+	return nil
+}
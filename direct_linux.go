@@ -0,0 +1,17 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package wal
+
+import (
+	"os"
+	"syscall"
+)
+
+// openDirect opens the file for writing with O_DIRECT, the flag and the permission.
+func openDirect(fs fileSystem, name string, flag int, perm os.FileMode) (file, error) {
+	return fs.OpenFile(name, os.O_WRONLY|syscall.O_DIRECT|flag, perm)
+}
@@ -0,0 +1,19 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package wal
+
+import (
+	"errors"
+	"os"
+)
+
+var errNoDirectIO = errors.New("direct I/O is not supported")
+
+// openDirect returns an error, the buffered I/O is used instead.
+func openDirect(fs fileSystem, name string, flag int, perm os.FileMode) (file, error) {
+	return nil, errNoDirectIO
+}
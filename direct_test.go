@@ -0,0 +1,102 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"testing"
+)
+
+func TestDirectIO(t *testing.T) {
+	file := "wal"
+	os.RemoveAll(file)
+	entry := func(i uint64) []byte {
+		return bytes.Repeat([]byte{byte(i)}, int(i*37%3000))
+	}
+	opts := &Options{SegmentEntries: 32, DirectIO: true}
+	w, err := Open(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	t.Log("direct I/O:", w.directIO)
+	check := func(w *WAL, last uint64) {
+		for i := uint64(1); i <= last; i++ {
+			if data, err := w.Read(i); err != nil || !bytes.Equal(data, entry(i)) {
+				t.Error(i, len(data), err)
+			}
+		}
+	}
+	for i := uint64(1); i <= 100; i++ {
+		w.Write(i, entry(i))
+		if i%7 == 0 {
+			if err = w.Flush(); err != nil {
+				t.Error(err)
+			}
+		}
+	}
+	if w.directIO {
+		if _, err = w.Read(100); err != io.EOF {
+			t.Error(err)
+		}
+	}
+	w.Flush()
+	check(w, 100)
+	if w.directIO {
+		for _, s := range w.segments {
+			if info, _ := os.Stat(s.logPath); info.Size()%directBlockSize != 0 {
+				t.Error(s.logPath, info.Size())
+			}
+		}
+	}
+	w.Close()
+	if w, err = Open(file, opts); err != nil {
+		t.Error(err)
+	}
+	check(w, 100)
+	for i := uint64(101); i <= 150; i++ {
+		w.Write(i, entry(i))
+	}
+	if err = w.Truncate(140); err != nil {
+		t.Error(err)
+	}
+	if err = w.Clean(70); err != nil {
+		t.Error(err)
+	}
+	w.Write(141, entry(141))
+	w.Close()
+	// reopen with buffered I/O
+	if w, err = Open(file, &Options{SegmentEntries: 32}); err != nil {
+		t.Error(err)
+	}
+	for i := uint64(70); i <= 141; i++ {
+		if data, err := w.Read(i); err != nil || !bytes.Equal(data, entry(i)) {
+			t.Error(i, len(data), err)
+		}
+	}
+	w.Write(142, entry(142))
+	w.Close()
+	if w, err = Open(file, opts); err != nil {
+		t.Error(err)
+	}
+	if data, err := w.Read(142); err != nil || !bytes.Equal(data, entry(142)) {
+		t.Error(len(data), err)
+	}
+	w.Close()
+	os.RemoveAll(file)
+}
+
+func TestPadding(t *testing.T) {
+	for _, n := range []int{paddingHeaderSize, 100, directBlockSize} {
+		buf := make([]byte, n)
+		appendPadding(buf)
+		if size := paddingSize(buf); size != n {
+			t.Error(n, size)
+		}
+	}
+	if size := paddingSize([]byte{0, 0, 0, 0, 0, 0, 0, 0}); size != 0 {
+		t.Error(size)
+	}
+}
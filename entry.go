@@ -0,0 +1,37 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+// Entry represents an entry with a header.
+type Entry struct {
+	// Type is the entry type defined by the application.
+	Type uint8
+	// Flags is the entry flags defined by the application.
+	Flags uint64
+	// Timestamp is the entry timestamp.
+	Timestamp int64
+	// Data is the entry data.
+	Data []byte
+}
+
+// WriteEntry writes an entry with the header to buffer.
+func (w *WAL) WriteEntry(index uint64, entry *Entry) (err error) {
+	w.mu.Lock()
+	err = w.write(index, entry.Data, &meta{header: true, typ: entry.Type, flags: entry.Flags, timestamp: entry.Timestamp})
+	w.mu.Unlock()
+	return
+}
+
+// ReadEntry returns an entry with the header by index.
+// The header of an entry written by Write is zero.
+func (w *WAL) ReadEntry(index uint64) (entry *Entry, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	var m meta
+	data, err := w.read(index, &m)
+	if err != nil {
+		return nil, err
+	}
+	return &Entry{Type: m.typ, Flags: m.flags, Timestamp: m.timestamp, Data: data}, nil
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"github.com/hslam/code"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func TestEntry(t *testing.T) {
+	file := "wal"
+	os.RemoveAll(file)
+	keys := &testKeys{current: 1, keys: map[uint64][]byte{1: bytes.Repeat([]byte{1}, 16)}}
+	opts := &Options{SegmentEntries: 4, Compression: NewFlateCodec(flate.BestSpeed), CompressionThreshold: 16, Cipher: NewCipher(keys)}
+	w, err := Open(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	entries := []*Entry{
+		{Type: 1, Flags: 3, Timestamp: 1600000000000000000, Data: []byte("Hello World")},
+		{Type: 2, Timestamp: -1, Data: bytes.Repeat([]byte("Hello World"), 16)},
+		{Data: []byte("zero header")},
+		{Type: 255, Flags: 1<<64 - 1, Timestamp: -1 << 63, Data: []byte{}},
+	}
+	for i, e := range entries {
+		if err = w.WriteEntry(uint64(i+1), e); err != nil {
+			t.Error(err)
+		}
+	}
+	w.Write(5, []byte("plain"))
+	w.Close()
+	w, err = Open(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	for i, e := range entries {
+		if entry, err := w.ReadEntry(uint64(i + 1)); err != nil {
+			t.Error(err)
+		} else if entry.Type != e.Type || entry.Flags != e.Flags || entry.Timestamp != e.Timestamp || !bytes.Equal(entry.Data, e.Data) {
+			t.Error(i, entry)
+		}
+		if data, err := w.Read(uint64(i + 1)); err != nil {
+			t.Error(err)
+		} else if !bytes.Equal(data, e.Data) {
+			t.Error(i, data)
+		}
+	}
+	if entry, err := w.ReadEntry(5); err != nil {
+		t.Error(err)
+	} else if !reflect.DeepEqual(entry, &Entry{Data: []byte("plain")}) {
+		t.Error(entry)
+	}
+	w.Close()
+	os.RemoveAll(file)
+}
+
+func TestEntryHeaderVersion(t *testing.T) {
+	w := &WAL{}
+	// A header of a later version with an unknown field.
+	header := []byte{2, 7, 3, 4, 0xff, 0x01}
+	body := append([]byte{flagHeader, byte(len(header))}, header...)
+	body = append(body, "data"...)
+	entryData := make([]byte, 10+len(body))
+	n := code.EncodeVarint(entryData, uint64(len(body))|recordExtended)
+	entryData = append(entryData[:n], body...)
+	var m meta
+	if data, err := w.decode(1, entryData, &m); err != nil {
+		t.Error(err)
+	} else if string(data) != "data" {
+		t.Error(string(data))
+	}
+	if m.typ != 7 || m.flags != 3 || m.timestamp != 2 {
+		t.Error(m)
+	}
+}
@@ -0,0 +1,135 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"io"
+	"os"
+	"runtime"
+)
+
+// fileSystem is the set of file system operations used by the write-ahead log.
+type fileSystem interface {
+	Create(name string) (file, error)
+	Open(name string) (file, error)
+	OpenFile(name string, flag int, perm os.FileMode) (file, error)
+	Remove(name string) error
+	Rename(oldpath, newpath string) error
+	Link(oldname, newname string) error
+	MkdirAll(path string, perm os.FileMode) error
+	Stat(name string) (os.FileInfo, error)
+	// SyncDir commits the creations, renames and removals of the files in the
+	// directory to stable storage.
+	SyncDir(dir string) error
+}
+
+// file is the set of file operations used by the write-ahead log.
+type file interface {
+	io.Reader
+	io.Writer
+	io.ReaderAt
+	io.WriterAt
+	io.Seeker
+	io.Closer
+	Name() string
+	Fd() uintptr
+	Stat() (os.FileInfo, error)
+	Sync() error
+	Truncate(size int64) error
+}
+
+// osFS implements the fileSystem interface by the os package.
+type osFS struct{}
+
+func (osFS) Create(name string) (file, error) {
+	f, err := os.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Open(name string) (file, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFS) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFS) Link(oldname, newname string) error {
+	return os.Link(oldname, newname)
+}
+
+func (osFS) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFS) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFS) SyncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		// A directory can not be synced on windows.
+		return nil
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// permFS creates the files and the directories of the underlying file system
+// with the permissions, which are masked by the umask.
+type permFS struct {
+	fileSystem
+	dirMode  os.FileMode
+	fileMode os.FileMode
+}
+
+func (fs permFS) Create(name string) (file, error) {
+	return fs.fileSystem.OpenFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC, fs.fileMode)
+}
+
+func (fs permFS) OpenFile(name string, flag int, perm os.FileMode) (file, error) {
+	return fs.fileSystem.OpenFile(name, flag, fs.fileMode)
+}
+
+func (fs permFS) MkdirAll(path string, perm os.FileMode) error {
+	return fs.fileSystem.MkdirAll(path, fs.dirMode)
+}
+
+func fd(f file) int {
+	return int(f.Fd())
+}
+
+func fsize(f file) (int, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	return int(info.Size()), nil
+}
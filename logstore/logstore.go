@@ -0,0 +1,205 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+// Package logstore implements a raft log store on top of the write-ahead log.
+package logstore
+
+import (
+	"errors"
+	"github.com/hslam/code"
+	"github.com/hslam/wal"
+	"sync"
+)
+
+var (
+	// ErrLogNotFound is returned when the log is not found.
+	ErrLogNotFound = errors.New("log not found")
+	// ErrRangeNotSupported is returned when deleting a range in the middle of the log.
+	ErrRangeNotSupported = errors.New("range not supported")
+	// ErrCorrupt is returned when an entry can not be decoded to a log.
+	ErrCorrupt = errors.New("corrupt")
+)
+
+// LogType is the type of a log.
+type LogType uint8
+
+// Log is a raft log entry.
+type Log struct {
+	// Index holds the index of the log entry.
+	Index uint64
+	// Term holds the election term of the log entry.
+	Term uint64
+	// Type holds the type of the log entry.
+	Type LogType
+	// Data holds the log entry's type-specific data.
+	Data []byte
+}
+
+// LogStore is used to provide an interface for storing
+// and retrieving logs in a durable fashion.
+type LogStore interface {
+	// FirstIndex returns the first index written. 0 for no entries.
+	FirstIndex() (uint64, error)
+	// LastIndex returns the last index written. 0 for no entries.
+	LastIndex() (uint64, error)
+	// GetLog gets a log entry at a given index.
+	GetLog(index uint64, log *Log) error
+	// StoreLog stores a log entry.
+	StoreLog(log *Log) error
+	// StoreLogs stores multiple log entries.
+	StoreLogs(logs []*Log) error
+	// DeleteRange deletes a range of log entries. The range is inclusive.
+	DeleteRange(min, max uint64) error
+}
+
+// Store implements the LogStore interface by a write-ahead log.
+type Store struct {
+	mu  sync.Mutex
+	wal *wal.WAL
+	buf []byte
+}
+
+// Open opens a store with the write-ahead log options.
+func Open(path string, opts *wal.Options) (*Store, error) {
+	w, err := wal.Open(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	return New(w), nil
+}
+
+// New returns a new store by the write-ahead log.
+func New(w *wal.WAL) *Store {
+	return &Store{wal: w}
+}
+
+// WAL returns the underlying write-ahead log.
+func (s *Store) WAL() *wal.WAL {
+	return s.wal
+}
+
+// FirstIndex returns the first index written. 0 for no entries.
+func (s *Store) FirstIndex() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	first, last, err := s.indexes()
+	if err != nil || last < first {
+		return 0, err
+	}
+	return first, nil
+}
+
+// LastIndex returns the last index written. 0 for no entries.
+func (s *Store) LastIndex() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	first, last, err := s.indexes()
+	if err != nil || last < first {
+		return 0, err
+	}
+	return last, nil
+}
+
+func (s *Store) indexes() (first, last uint64, err error) {
+	if first, err = s.wal.FirstIndex(); err != nil {
+		return
+	}
+	last, err = s.wal.LastIndex()
+	return
+}
+
+// GetLog gets a log entry at a given index.
+func (s *Store) GetLog(index uint64, log *Log) error {
+	data, err := s.wal.Read(index)
+	if err == wal.ErrOutOfRange {
+		return ErrLogNotFound
+	} else if err != nil {
+		return err
+	}
+	return decode(data, index, log)
+}
+
+// StoreLog stores a log entry.
+func (s *Store) StoreLog(log *Log) error {
+	return s.StoreLogs([]*Log{log})
+}
+
+// StoreLogs stores multiple log entries and commits them to stable storage.
+func (s *Store) StoreLogs(logs []*Log) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(logs) == 0 {
+		return nil
+	}
+	first, last, err := s.indexes()
+	if err != nil {
+		return err
+	}
+	if last < first && logs[0].Index != last+1 {
+		// The store is empty, so the logs can start at any index.
+		if err = s.wal.ResetTo(logs[0].Index); err != nil {
+			return err
+		}
+	}
+	for _, log := range logs {
+		s.buf = encode(s.buf, log)
+		if err := s.wal.Write(log.Index, s.buf); err != nil {
+			return err
+		}
+	}
+	if err := s.wal.Flush(); err != nil {
+		return err
+	}
+	return s.wal.Sync()
+}
+
+// DeleteRange deletes a range of log entries. The range is inclusive.
+// The range must contain the first or the last index, because the entries are
+// deleted by the Clean or the Truncate method of the write-ahead log.
+func (s *Store) DeleteRange(min, max uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	first, last, err := s.indexes()
+	if err != nil {
+		return err
+	}
+	if min > max || last < first || max < first || min > last {
+		return nil
+	}
+	if min <= first && max >= last {
+		return s.wal.ResetTo(last + 1)
+	} else if min <= first {
+		return s.wal.Clean(max + 1)
+	} else if max >= last {
+		return s.wal.Truncate(min - 1)
+	}
+	return ErrRangeNotSupported
+}
+
+// Close closes the store.
+func (s *Store) Close() error {
+	return s.wal.Close()
+}
+
+func encode(buf []byte, log *Log) []byte {
+	buf = code.CheckBuffer(buf, uint64(11+len(log.Data)))
+	n := code.EncodeVarint(buf, log.Term)
+	buf[n] = byte(log.Type)
+	n++
+	n += uint64(copy(buf[n:], log.Data))
+	return buf[:n]
+}
+
+func decode(data []byte, index uint64, log *Log) error {
+	if len(data) < 2 {
+		return ErrCorrupt
+	}
+	n := code.DecodeVarint(data, &log.Term)
+	if n >= uint64(len(data)) {
+		return ErrCorrupt
+	}
+	log.Index = index
+	log.Type = LogType(data[n])
+	log.Data = data[n+1:]
+	return nil
+}
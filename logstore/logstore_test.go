@@ -0,0 +1,201 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package logstore
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/hslam/wal"
+	"os"
+	"testing"
+)
+
+func testLog(index, term uint64) *Log {
+	return &Log{Index: index, Term: term, Type: LogType(index % 3), Data: []byte(fmt.Sprintf("log-%d", index))}
+}
+
+func testLogs(first, last, term uint64) []*Log {
+	var logs []*Log
+	for i := first; i <= last; i++ {
+		logs = append(logs, testLog(i, term))
+	}
+	return logs
+}
+
+func checkLog(t *testing.T, store LogStore, expect *Log) {
+	t.Helper()
+	var log Log
+	if err := store.GetLog(expect.Index, &log); err != nil {
+		t.Fatal(err)
+	}
+	if log.Index != expect.Index || log.Term != expect.Term || log.Type != expect.Type || !bytes.Equal(log.Data, expect.Data) {
+		t.Fatalf("%+v != %+v", log, expect)
+	}
+}
+
+func checkIndexes(t *testing.T, store LogStore, first, last uint64) {
+	t.Helper()
+	if index, err := store.FirstIndex(); err != nil {
+		t.Fatal(err)
+	} else if index != first {
+		t.Fatalf("first index %d != %d", index, first)
+	}
+	if index, err := store.LastIndex(); err != nil {
+		t.Fatal(err)
+	} else if index != last {
+		t.Fatalf("last index %d != %d", index, last)
+	}
+}
+
+// testLogStore runs the conformance tests of the LogStore interface.
+func testLogStore(t *testing.T, newStore func() LogStore) {
+	t.Run("Empty", func(t *testing.T) {
+		store := newStore()
+		checkIndexes(t, store, 0, 0)
+		var log Log
+		if err := store.GetLog(1, &log); err != ErrLogNotFound {
+			t.Fatal(err)
+		}
+	})
+	t.Run("StoreLog", func(t *testing.T) {
+		store := newStore()
+		if err := store.StoreLog(testLog(1, 1)); err != nil {
+			t.Fatal(err)
+		}
+		checkIndexes(t, store, 1, 1)
+		checkLog(t, store, testLog(1, 1))
+		var log Log
+		if err := store.GetLog(2, &log); err != ErrLogNotFound {
+			t.Fatal(err)
+		}
+	})
+	t.Run("StoreLogs", func(t *testing.T) {
+		store := newStore()
+		if err := store.StoreLogs(testLogs(1, 10, 2)); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.StoreLogs(nil); err != nil {
+			t.Fatal(err)
+		}
+		checkIndexes(t, store, 1, 10)
+		for _, log := range testLogs(1, 10, 2) {
+			checkLog(t, store, log)
+		}
+	})
+	t.Run("StartIndex", func(t *testing.T) {
+		store := newStore()
+		if err := store.StoreLogs(testLogs(5, 10, 1)); err != nil {
+			t.Fatal(err)
+		}
+		checkIndexes(t, store, 5, 10)
+		checkLog(t, store, testLog(5, 1))
+	})
+	t.Run("DeleteRangePrefix", func(t *testing.T) {
+		store := newStore()
+		store.StoreLogs(testLogs(1, 10, 1))
+		if err := store.DeleteRange(1, 4); err != nil {
+			t.Fatal(err)
+		}
+		checkIndexes(t, store, 5, 10)
+		var log Log
+		if err := store.GetLog(4, &log); err != ErrLogNotFound {
+			t.Fatal(err)
+		}
+		checkLog(t, store, testLog(5, 1))
+	})
+	t.Run("DeleteRangeSuffix", func(t *testing.T) {
+		store := newStore()
+		store.StoreLogs(testLogs(1, 10, 1))
+		if err := store.DeleteRange(7, 10); err != nil {
+			t.Fatal(err)
+		}
+		checkIndexes(t, store, 1, 6)
+		if err := store.StoreLogs(testLogs(7, 8, 2)); err != nil {
+			t.Fatal(err)
+		}
+		checkIndexes(t, store, 1, 8)
+		checkLog(t, store, testLog(6, 1))
+		checkLog(t, store, testLog(7, 2))
+	})
+	t.Run("DeleteRangeAll", func(t *testing.T) {
+		store := newStore()
+		store.StoreLogs(testLogs(1, 10, 1))
+		if err := store.DeleteRange(1, 10); err != nil {
+			t.Fatal(err)
+		}
+		checkIndexes(t, store, 0, 0)
+		if err := store.StoreLogs(testLogs(21, 22, 3)); err != nil {
+			t.Fatal(err)
+		}
+		checkIndexes(t, store, 21, 22)
+		checkLog(t, store, testLog(21, 3))
+	})
+	t.Run("DeleteRangeOutside", func(t *testing.T) {
+		store := newStore()
+		store.StoreLogs(testLogs(5, 10, 1))
+		if err := store.DeleteRange(1, 3); err != nil {
+			t.Fatal(err)
+		}
+		if err := store.DeleteRange(11, 20); err != nil {
+			t.Fatal(err)
+		}
+		checkIndexes(t, store, 5, 10)
+	})
+}
+
+func TestStore(t *testing.T) {
+	path := "wal"
+	var store *Store
+	testLogStore(t, func() LogStore {
+		if store != nil {
+			store.Close()
+		}
+		os.RemoveAll(path)
+		var err error
+		store, err = Open(path, &wal.Options{SegmentEntries: 4})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return store
+	})
+	store.Close()
+	os.RemoveAll(path)
+}
+
+func TestStoreReopen(t *testing.T) {
+	path := "wal"
+	os.RemoveAll(path)
+	store, err := Open(path, &wal.Options{SegmentEntries: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.StoreLogs(testLogs(1, 10, 1))
+	store.DeleteRange(1, 3)
+	store.DeleteRange(9, 10)
+	store.Close()
+	store, err = Open(path, &wal.Options{SegmentEntries: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIndexes(t, store, 4, 8)
+	for _, log := range testLogs(4, 8, 1) {
+		checkLog(t, store, log)
+	}
+	if err := store.DeleteRange(5, 6); err != ErrRangeNotSupported {
+		t.Fatal(err)
+	}
+	store.DeleteRange(4, 8)
+	store.Close()
+	store, err = Open(path, &wal.Options{SegmentEntries: 4})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkIndexes(t, store, 0, 0)
+	if err := store.StoreLog(testLog(9, 2)); err != nil {
+		t.Fatal(err)
+	}
+	checkIndexes(t, store, 9, 9)
+	store.Close()
+	os.RemoveAll(path)
+}
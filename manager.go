@@ -0,0 +1,249 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultMemoryBudget is the default memory budget of the write buffers of a manager.
+	DefaultMemoryBudget = 1024 * 1024 * 16
+	// DefaultSyncInterval is the default interval of the sync goroutine of a manager.
+	DefaultSyncInterval = time.Millisecond * 100
+)
+
+// ManagerOptions represents manager options.
+type ManagerOptions struct {
+	// Options is the options of each log. WriteBufferSize is ignored, the write
+	// buffers are taken from a shared pool and grow on demand within the memory budget.
+	Options *Options
+	// MemoryBudget is the total size of the write buffers of all logs.
+	// A log is flushed when a write exceeds the budget.
+	MemoryBudget int
+	// SyncInterval is the interval to flush and sync the written logs.
+	SyncInterval time.Duration
+}
+
+// Manager manages the named write-ahead logs in the subdirectories of a root directory.
+// The logs share a pool of write buffers, a memory budget of them and a sync goroutine.
+// A log takes a write buffer from the pool when it buffers an entry, and returns
+// it when the buffer is flushed, so the idle logs hold no write buffers.
+// It is safe for concurrent use by multiple goroutines.
+type Manager struct {
+	mu       sync.Mutex
+	path     string
+	opts     Options
+	interval time.Duration
+	budget   *memoryBudget
+	logs     map[string]*WAL
+	done     chan struct{}
+	wg       sync.WaitGroup
+	closed   bool
+}
+
+// OpenManager opens a manager of the root directory with options.
+func OpenManager(path string, opts *ManagerOptions) (*Manager, error) {
+	if opts == nil {
+		opts = &ManagerOptions{}
+	}
+	logOpts := DefaultOptions()
+	if opts.Options != nil {
+		*logOpts = *opts.Options
+		if err := logOpts.check(); err != nil {
+			return nil, err
+		}
+	}
+	if err := os.MkdirAll(path, logOpts.DirMode); err != nil {
+		return nil, err
+	}
+	m := &Manager{
+		path:     path,
+		opts:     *logOpts,
+		interval: opts.SyncInterval,
+		budget:   &memoryBudget{limit: int64(opts.MemoryBudget)},
+		logs:     make(map[string]*WAL),
+		done:     make(chan struct{}),
+	}
+	if m.budget.limit < 1 {
+		m.budget.limit = DefaultMemoryBudget
+	}
+	if m.interval <= 0 {
+		m.interval = DefaultSyncInterval
+	}
+	m.opts.budget = m.budget
+	m.wg.Add(1)
+	go m.run()
+	return m, nil
+}
+
+// Log returns the log with the name, opening or creating it if necessary.
+// Closing the log is optional, the manager reopens a closed log.
+func (m *Manager) Log(name string) (*WAL, error) {
+	if err := checkName(name); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	if w, ok := m.logs[name]; ok {
+		w.mu.Lock()
+		closed := w.closed
+		w.mu.Unlock()
+		if !closed {
+			return w, nil
+		}
+	}
+	opts := m.opts
+	w, err := Open(filepath.Join(m.path, name), &opts)
+	if err != nil {
+		return nil, err
+	}
+	m.logs[name] = w
+	return w, nil
+}
+
+// Logs returns the sorted names of the logs in the root directory.
+func (m *Manager) Logs() ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+	infos, err := ioutil.ReadDir(m.path)
+	if err != nil {
+		return nil, err
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if info.IsDir() {
+			names = append(names, info.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Delete closes the log with the name and removes its directory.
+func (m *Manager) Delete(name string) error {
+	if err := checkName(name); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+	if w, ok := m.logs[name]; ok {
+		delete(m.logs, name)
+		if err := w.Close(); err != nil && err != ErrClosed {
+			return err
+		}
+	}
+	return os.RemoveAll(filepath.Join(m.path, name))
+}
+
+// Close stops the sync goroutine and closes all logs.
+func (m *Manager) Close() (err error) {
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return nil
+	}
+	m.closed = true
+	close(m.done)
+	m.mu.Unlock()
+	m.wg.Wait()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name, w := range m.logs {
+		if e := w.Close(); e != nil && e != ErrClosed && err == nil {
+			err = e
+		}
+		delete(m.logs, name)
+	}
+	return err
+}
+
+func (m *Manager) run() {
+	defer m.wg.Done()
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			m.syncLogs()
+		case <-m.done:
+			return
+		}
+	}
+}
+
+// syncLogs flushes and syncs the logs written since the last sync.
+func (m *Manager) syncLogs() {
+	m.mu.Lock()
+	logs := make([]*WAL, 0, len(m.logs))
+	for _, w := range m.logs {
+		logs = append(logs, w)
+	}
+	m.mu.Unlock()
+	for _, w := range logs {
+		w.mu.Lock()
+		if !w.closed && (len(w.writeBuffer) > 0 || w.unsynced) {
+			if w.flush() == nil {
+				w.sync()
+			}
+		}
+		w.mu.Unlock()
+	}
+}
+
+func checkName(name string) error {
+	if len(name) == 0 || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return ErrInvalidName
+	}
+	return nil
+}
+
+// memoryBudget is the pool and the memory budget of the write buffers shared by the logs.
+type memoryBudget struct {
+	used  int64
+	limit int64
+	pool  sync.Pool
+}
+
+// get returns an empty write buffer from the pool, or nil if the pool is empty.
+func (b *memoryBudget) get() []byte {
+	if buf, ok := b.pool.Get().(*[]byte); ok {
+		return *buf
+	}
+	return nil
+}
+
+// put returns the write buffer to the pool.
+func (b *memoryBudget) put(buf []byte) {
+	if cap(buf) > 0 {
+		buf = buf[:0]
+		b.pool.Put(&buf)
+	}
+}
+
+// acquire adds n bytes to the used memory, and reports whether the budget is exceeded.
+func (b *memoryBudget) acquire(n int) bool {
+	return atomic.AddInt64(&b.used, int64(n)) > b.limit
+}
+
+// release subtracts n bytes from the used memory.
+func (b *memoryBudget) release(n int) {
+	atomic.AddInt64(&b.used, -int64(n))
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestManager(t *testing.T) {
+	file := "wal"
+	os.RemoveAll(file)
+	opts := &ManagerOptions{
+		Options:      &Options{SegmentEntries: 4},
+		MemoryBudget: 64,
+		SyncInterval: time.Millisecond,
+	}
+	m, err := OpenManager(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	for _, name := range []string{"", ".", "..", "a/b"} {
+		if _, err = m.Log(name); err != ErrInvalidName {
+			t.Error(name, err)
+		}
+	}
+	names := []string{"tenant-1", "tenant-2", "tenant-3"}
+	for _, name := range names {
+		w, err := m.Log(name)
+		if err != nil {
+			t.Error(err)
+		}
+		for i := uint64(1); i <= 10; i++ {
+			w.Write(i, []byte(fmt.Sprintf("%s-%d", name, i)))
+		}
+		if w2, _ := m.Log(name); w2 != w {
+			t.Error(name)
+		}
+	}
+	if atomic.LoadInt64(&m.budget.used) > m.budget.limit {
+		t.Error(atomic.LoadInt64(&m.budget.used))
+	}
+	// the sync goroutine flushes the write buffers
+	deadline := time.Now().Add(time.Second)
+	for atomic.LoadInt64(&m.budget.used) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if atomic.LoadInt64(&m.budget.used) != 0 {
+		t.Error(atomic.LoadInt64(&m.budget.used))
+	}
+	// the flushed write buffers are returned to the shared pool
+	for _, name := range names {
+		w, _ := m.Log(name)
+		w.mu.Lock()
+		if w.writeBuffer != nil {
+			t.Error(name, cap(w.writeBuffer))
+		}
+		w.mu.Unlock()
+	}
+	if logs, err := m.Logs(); err != nil || !reflect.DeepEqual(logs, names) {
+		t.Error(logs, err)
+	}
+	w, _ := m.Log(names[0])
+	w.Close()
+	if w, err = m.Log(names[0]); err != nil {
+		t.Error(err)
+	} else if last, _ := w.LastIndex(); last != 10 {
+		t.Error(last)
+	}
+	if err = m.Delete(names[1]); err != nil {
+		t.Error(err)
+	}
+	if logs, err := m.Logs(); err != nil || !reflect.DeepEqual(logs, []string{names[0], names[2]}) {
+		t.Error(logs, err)
+	}
+	if err = m.Close(); err != nil {
+		t.Error(err)
+	}
+	if _, err = m.Log(names[0]); err != ErrClosed {
+		t.Error(err)
+	}
+	m, err = OpenManager(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	for _, name := range []string{names[0], names[2]} {
+		w, err := m.Log(name)
+		if err != nil {
+			t.Error(err)
+			continue
+		}
+		for i := uint64(1); i <= 10; i++ {
+			if data, err := w.Read(i); err != nil || string(data) != fmt.Sprintf("%s-%d", name, i) {
+				t.Error(name, i, string(data), err)
+			}
+		}
+	}
+	if w, err := m.Log(names[1]); err != nil {
+		t.Error(err)
+	} else if last, _ := w.LastIndex(); last != 0 {
+		t.Error(last)
+	}
+	m.Close()
+	os.RemoveAll(file)
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"path/filepath"
+)
+
+const (
+	// manifestName is the name of the manifest file.
+	manifestName    = "MANIFEST"
+	manifestTmp     = "MANIFEST.tmp"
+	manifestMagic   = "WALM"
+	manifestVersion = 2
+)
+
+const (
+	// pendingClean is a clean that removes the segments before the offset,
+	// after the log file with the clean suffix has been written.
+	pendingClean = iota + 1
+	// pendingTruncate is a truncate that removes the segments after the offset,
+	// after the log file with the truncate suffix has been written.
+	pendingTruncate
+	// pendingReset is a reset that removes all segments but the empty one at
+	// the offset, after the log file with the clean suffix has been written.
+	pendingReset
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// manifest describes the segments of a write-ahead log and the pending operation.
+// It is the magic, the version, the fields in varints and a crc32 checksum.
+// The last index and the sizes are the ones when the manifest is written,
+// the active segment may have grown since.
+type manifest struct {
+	firstIndex    uint64
+	lastIndex     uint64
+	segments      []manifestSegment
+	pending       uint64
+	pendingOffset uint64
+}
+
+type manifestSegment struct {
+	name   string
+	offset uint64
+	size   uint64
+}
+
+func (m *manifest) marshal() []byte {
+	buf := make([]byte, 0, 64+len(m.segments)*48)
+	buf = append(buf, manifestMagic...)
+	buf = append(buf, manifestVersion)
+	buf = appendUvarint(buf, m.firstIndex)
+	buf = appendUvarint(buf, m.lastIndex)
+	buf = appendUvarint(buf, uint64(len(m.segments)))
+	for _, s := range m.segments {
+		buf = appendUvarint(buf, uint64(len(s.name)))
+		buf = append(buf, s.name...)
+		buf = appendUvarint(buf, s.offset)
+		buf = appendUvarint(buf, s.size)
+	}
+	buf = appendUvarint(buf, m.pending)
+	buf = appendUvarint(buf, m.pendingOffset)
+	var sum [4]byte
+	binary.BigEndian.PutUint32(sum[:], crc32.Checksum(buf, crcTable))
+	return append(buf, sum[:]...)
+}
+
+func (m *manifest) unmarshal(data []byte) error {
+	if len(data) < len(manifestMagic)+1+4 || string(data[:len(manifestMagic)]) != manifestMagic {
+		return ErrBadManifest
+	}
+	body, sum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.Checksum(body, crcTable) != binary.BigEndian.Uint32(sum) {
+		return ErrBadManifest
+	}
+	version := body[len(manifestMagic)]
+	if version < 1 || version > manifestVersion {
+		return ErrBadManifest
+	}
+	d := &decoder{buf: body[len(manifestMagic)+1:]}
+	m.firstIndex = d.uvarint()
+	m.lastIndex = d.uvarint()
+	n := d.uvarint()
+	if n > uint64(len(d.buf)) {
+		return ErrBadManifest
+	}
+	m.segments = make([]manifestSegment, 0, n)
+	for i := uint64(0); i < n; i++ {
+		var s manifestSegment
+		s.name = string(d.bytes())
+		s.offset = d.uvarint()
+		s.size = d.uvarint()
+		m.segments = append(m.segments, s)
+	}
+	m.pending, m.pendingOffset = 0, 0
+	if version > 1 {
+		m.pending = d.uvarint()
+		m.pendingOffset = d.uvarint()
+	}
+	if d.err != nil || len(d.buf) > 0 {
+		return ErrBadManifest
+	}
+	return nil
+}
+
+// writeManifest replaces the manifest in the directory atomically.
+func writeManifest(fs fileSystem, dir string, m *manifest) error {
+	return writeFile(fs, filepath.Join(dir, manifestTmp), filepath.Join(dir, manifestName), m.marshal())
+}
+
+// writeFile replaces the file atomically by writing and syncing a temporary file,
+// renaming it to the file and syncing the directory. The directory sync also
+// commits the files created, renamed and removed in the directory before.
+func writeFile(fs fileSystem, tmpName, name string, data []byte) (err error) {
+	f, err := fs.Create(tmpName)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = fs.Rename(tmpName, name); err != nil {
+		return err
+	}
+	return fs.SyncDir(filepath.Dir(name))
+}
+
+// readManifest reads the manifest in the directory.
+func readManifest(fs fileSystem, dir string) (*manifest, error) {
+	f, err := fs.Open(filepath.Join(dir, manifestName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	m := &manifest{}
+	if err = m.unmarshal(data); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var b [binary.MaxVarintLen64]byte
+	return append(buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = ErrBadManifest
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uvarint()
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.buf)) {
+		d.err = ErrBadManifest
+		return nil
+	}
+	v := d.buf[:n]
+	d.buf = d.buf[n:]
+	return v
+}
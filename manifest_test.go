@@ -0,0 +1,90 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestManifest(t *testing.T) {
+	m := &manifest{firstIndex: 3, lastIndex: 12, segments: []manifestSegment{
+		{name: "00000000000000000002.log", offset: 2, size: 100},
+		{name: "00000000000000000008.log", offset: 8, size: 0},
+	}}
+	data := m.marshal()
+	var got manifest
+	if err := got.unmarshal(data); err != nil {
+		t.Error(err)
+	} else if fmt.Sprint(got) != fmt.Sprint(*m) {
+		t.Error(got)
+	}
+	for i := 0; i < len(data); i++ {
+		data[i] ^= 1
+		if err := got.unmarshal(data); err != ErrBadManifest {
+			t.Error(i, err)
+		}
+		data[i] ^= 1
+	}
+	if err := got.unmarshal(data[:len(data)-1]); err != ErrBadManifest {
+		t.Error(err)
+	}
+}
+
+func TestManifestLoad(t *testing.T) {
+	file := "wal"
+	os.RemoveAll(file)
+	opts := &Options{SegmentEntries: 4}
+	w, err := Open(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	for i := uint64(1); i <= 10; i++ {
+		w.Write(i, []byte(fmt.Sprintf("entry-%d", i)))
+	}
+	w.Close()
+	check := func(first, last uint64) {
+		w, err := Open(file, opts)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer w.Close()
+		if index, _ := w.FirstIndex(); index != first {
+			t.Error(index, first)
+		}
+		if index, _ := w.LastIndex(); index != last {
+			t.Error(index, last)
+		}
+		for i := first; i <= last; i++ {
+			if data, err := w.Read(i); err != nil {
+				t.Error(i, err)
+			} else if !bytes.Equal(data, []byte(fmt.Sprintf("entry-%d", i))) {
+				t.Error(i, string(data))
+			}
+		}
+	}
+	// stray files are ignored
+	ioutil.WriteFile(filepath.Join(file, w.logName(99)), []byte("stray"), 0666)
+	ioutil.WriteFile(filepath.Join(file, w.logName(0)+cleanSuffix), []byte("stray"), 0666)
+	check(1, 10)
+	// logs written before the manifest are scanned
+	os.Remove(filepath.Join(file, w.logName(99)))
+	os.Remove(filepath.Join(file, w.logName(0)+cleanSuffix))
+	os.Remove(filepath.Join(file, manifestName))
+	check(1, 10)
+	if _, err := os.Stat(filepath.Join(file, manifestName)); err != nil {
+		t.Error(err)
+	}
+	// a corrupt manifest is an error
+	ioutil.WriteFile(filepath.Join(file, manifestName), []byte("WALM"), 0666)
+	if _, err := Open(file, opts); err != ErrBadManifest {
+		t.Error(err)
+	}
+	os.RemoveAll(file)
+}
@@ -0,0 +1,166 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package raftstorage
+
+import (
+	"encoding/binary"
+)
+
+type encoder struct {
+	buf []byte
+}
+
+func (e *encoder) uint64(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	e.buf = append(e.buf, b[:binary.PutUvarint(b[:], v)]...)
+}
+
+func (e *encoder) uint64s(v []uint64) {
+	e.uint64(uint64(len(v)))
+	for _, u := range v {
+		e.uint64(u)
+	}
+}
+
+func (e *encoder) bytes(v []byte) {
+	e.uint64(uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *encoder) hardState(st HardState) {
+	e.uint64(st.Term)
+	e.uint64(st.Vote)
+	e.uint64(st.Commit)
+}
+
+func (e *encoder) confState(cs ConfState) {
+	e.uint64s(cs.Voters)
+	e.uint64s(cs.Learners)
+	e.uint64s(cs.VotersOutgoing)
+	e.uint64s(cs.LearnersNext)
+	if cs.AutoLeave {
+		e.uint64(1)
+	} else {
+		e.uint64(0)
+	}
+}
+
+func (e *encoder) snapshot(snap Snapshot) {
+	e.uint64(snap.Metadata.Index)
+	e.uint64(snap.Metadata.Term)
+	e.confState(snap.Metadata.ConfState)
+	e.bytes(snap.Data)
+}
+
+func (e *encoder) terms(terms []termRun) {
+	e.uint64(uint64(len(terms)))
+	for _, run := range terms {
+		e.uint64(run.index)
+		e.uint64(run.term)
+	}
+}
+
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) uint64() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.err = ErrCorrupt
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) uint64s() []uint64 {
+	n := d.uint64()
+	if n > uint64(len(d.buf)) {
+		d.err = ErrCorrupt
+		return nil
+	}
+	var v []uint64
+	for i := uint64(0); i < n; i++ {
+		v = append(v, d.uint64())
+	}
+	return v
+}
+
+func (d *decoder) bytes() []byte {
+	n := d.uint64()
+	if n > uint64(len(d.buf)) {
+		d.err = ErrCorrupt
+		return nil
+	}
+	if n == 0 {
+		return nil
+	}
+	v := d.buf[:n]
+	d.buf = d.buf[n:]
+	return v
+}
+
+func (d *decoder) hardState() (st HardState) {
+	st.Term = d.uint64()
+	st.Vote = d.uint64()
+	st.Commit = d.uint64()
+	return
+}
+
+func (d *decoder) confState() (cs ConfState) {
+	cs.Voters = d.uint64s()
+	cs.Learners = d.uint64s()
+	cs.VotersOutgoing = d.uint64s()
+	cs.LearnersNext = d.uint64s()
+	cs.AutoLeave = d.uint64() == 1
+	return
+}
+
+func (d *decoder) snapshot() (snap Snapshot) {
+	snap.Metadata.Index = d.uint64()
+	snap.Metadata.Term = d.uint64()
+	snap.Metadata.ConfState = d.confState()
+	snap.Data = d.bytes()
+	return
+}
+
+func (d *decoder) terms() []termRun {
+	n := d.uint64()
+	if n == 0 || n > uint64(len(d.buf)) {
+		d.err = ErrCorrupt
+		return nil
+	}
+	terms := make([]termRun, n)
+	for i := range terms {
+		terms[i].index = d.uint64()
+		terms[i].term = d.uint64()
+	}
+	return terms
+}
+
+// encodeEntry encodes the term, the type and the data of an entry.
+func encodeEntry(buf []byte, ent *Entry) []byte {
+	e := &encoder{buf: buf[:0]}
+	e.uint64(ent.Term)
+	e.uint64(uint64(ent.Type))
+	e.buf = append(e.buf, ent.Data...)
+	return e.buf
+}
+
+func decodeEntry(data []byte, index uint64, ent *Entry) error {
+	d := &decoder{buf: data}
+	ent.Term = d.uint64()
+	ent.Type = EntryType(d.uint64())
+	ent.Index = index
+	ent.Data = nil
+	if len(d.buf) > 0 {
+		ent.Data = d.buf
+	}
+	return d.err
+}
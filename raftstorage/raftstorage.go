@@ -0,0 +1,565 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+// Package raftstorage implements the storage interface of etcd raft on top of
+// the write-ahead log.
+//
+// The HardState, the ConfState, the snapshot and the term index are persisted
+// in the files next to the segments. The term index records the first index of
+// each term, so Term is answered without reading the entries.
+package raftstorage
+
+import (
+	"errors"
+	"github.com/hslam/wal"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+)
+
+const (
+	hardStateFile = "hardstate"
+	confStateFile = "confstate"
+	snapshotFile  = "snapshot"
+	termsFile     = "terms"
+	tmpSuffix     = ".tmp"
+)
+
+var (
+	// ErrCompacted is returned when the requested index is unavailable
+	// because it predates the first index.
+	ErrCompacted = errors.New("requested index is unavailable due to compaction")
+	// ErrSnapOutOfDate is returned when the requested snapshot index is older
+	// than the existing snapshot.
+	ErrSnapOutOfDate = errors.New("requested index is older than the existing snapshot")
+	// ErrUnavailable is returned when the requested index is unavailable.
+	ErrUnavailable = errors.New("requested entry at index is unavailable")
+	// ErrMissingEntries is returned when the appended entries leave a gap after the last index.
+	ErrMissingEntries = errors.New("missing log entries")
+	// ErrCorrupt is returned when a file or an entry can not be decoded.
+	ErrCorrupt = errors.New("corrupt")
+)
+
+// EntryType is the type of an entry.
+type EntryType int32
+
+const (
+	// EntryNormal is a normal entry.
+	EntryNormal EntryType = 0
+	// EntryConfChange is a configuration change entry.
+	EntryConfChange EntryType = 1
+	// EntryConfChangeV2 is a configuration change entry of version 2.
+	EntryConfChangeV2 EntryType = 2
+)
+
+// Entry is a raft log entry.
+type Entry struct {
+	Term  uint64
+	Index uint64
+	Type  EntryType
+	Data  []byte
+}
+
+// HardState is the persistent state of a raft node.
+type HardState struct {
+	Term   uint64
+	Vote   uint64
+	Commit uint64
+}
+
+// ConfState is the membership configuration of a raft group.
+type ConfState struct {
+	Voters         []uint64
+	Learners       []uint64
+	VotersOutgoing []uint64
+	LearnersNext   []uint64
+	AutoLeave      bool
+}
+
+// SnapshotMetadata is the metadata of a snapshot.
+type SnapshotMetadata struct {
+	ConfState ConfState
+	Index     uint64
+	Term      uint64
+}
+
+// Snapshot is a raft snapshot.
+type Snapshot struct {
+	Data     []byte
+	Metadata SnapshotMetadata
+}
+
+// Storage is the storage interface of etcd raft.
+type Storage interface {
+	// InitialState returns the saved HardState and ConfState information.
+	InitialState() (HardState, ConfState, error)
+	// Entries returns a slice of log entries in the range [lo,hi).
+	// MaxSize limits the total size of the log entries returned, but
+	// Entries returns at least one entry if any.
+	Entries(lo, hi, maxSize uint64) ([]Entry, error)
+	// Term returns the term of entry i, which must be in the range
+	// [FirstIndex()-1, LastIndex()].
+	Term(i uint64) (uint64, error)
+	// LastIndex returns the index of the last entry in the log.
+	LastIndex() (uint64, error)
+	// FirstIndex returns the index of the first log entry that is
+	// possibly available via Entries.
+	FirstIndex() (uint64, error)
+	// Snapshot returns the most recent snapshot.
+	Snapshot() (Snapshot, error)
+}
+
+// termRun records that the entries from index on have the term.
+type termRun struct {
+	index uint64
+	term  uint64
+}
+
+// WALStorage implements the Storage interface by a write-ahead log.
+type WALStorage struct {
+	mu        sync.Mutex
+	path      string
+	fileMode  os.FileMode
+	wal       *wal.WAL
+	hardState HardState
+	confState ConfState
+	snapshot  Snapshot
+	terms     []termRun
+	buf       []byte
+}
+
+// Open opens a storage with the write-ahead log options. The state files are
+// created with the FileMode of the options like the segments.
+func Open(path string, opts *wal.Options) (*WALStorage, error) {
+	w, err := wal.Open(path, opts)
+	if err != nil {
+		return nil, err
+	}
+	fileMode := wal.DefaultFileMode
+	if opts != nil {
+		// The options have been checked by wal.Open.
+		fileMode = opts.FileMode
+	}
+	s := &WALStorage{path: path, fileMode: fileMode.Perm(), wal: w, terms: []termRun{{}}}
+	if err = s.load(); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *WALStorage) load() (err error) {
+	if err = s.readFile(hardStateFile, func(d *decoder) { s.hardState = d.hardState() }); err != nil {
+		return err
+	}
+	if err = s.readFile(confStateFile, func(d *decoder) { s.confState = d.confState() }); err != nil {
+		return err
+	}
+	if err = s.readFile(snapshotFile, func(d *decoder) { s.snapshot = d.snapshot() }); err != nil {
+		return err
+	}
+	if err = s.readFile(termsFile, func(d *decoder) { s.terms = d.terms() }); err != nil {
+		return err
+	}
+	first, last, err := s.indexes()
+	if err != nil {
+		return err
+	}
+	meta := s.snapshot.Metadata
+	if meta.Index > last {
+		// ApplySnapshot was interrupted before the log was reset.
+		s.terms = []termRun{{index: meta.Index, term: meta.Term}}
+		if err = s.writeTerms(); err != nil {
+			return err
+		}
+		return s.wal.ResetTo(meta.Index + 1)
+	} else if s.terms[0].index > first-1 {
+		// ApplySnapshot was interrupted after the terms were written.
+		return s.wal.ResetTo(s.terms[0].index + 1)
+	}
+	s.truncateTerms(last + 1)
+	return nil
+}
+
+// WAL returns the underlying write-ahead log.
+func (s *WALStorage) WAL() *wal.WAL {
+	return s.wal
+}
+
+// InitialState returns the saved HardState and ConfState information.
+func (s *WALStorage) InitialState() (HardState, ConfState, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hardState, s.confState, nil
+}
+
+// SetHardState saves the current HardState.
+func (s *WALStorage) SetHardState(st HardState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := &encoder{}
+	e.hardState(st)
+	if err := s.writeFile(hardStateFile, e.buf); err != nil {
+		return err
+	}
+	s.hardState = st
+	return nil
+}
+
+// SetConfState saves the current ConfState.
+func (s *WALStorage) SetConfState(cs ConfState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.setConfState(cs)
+}
+
+func (s *WALStorage) setConfState(cs ConfState) error {
+	e := &encoder{}
+	e.confState(cs)
+	if err := s.writeFile(confStateFile, e.buf); err != nil {
+		return err
+	}
+	s.confState = cs
+	return nil
+}
+
+// Entries returns a slice of log entries in the range [lo,hi).
+func (s *WALStorage) Entries(lo, hi, maxSize uint64) ([]Entry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	first, last, err := s.indexes()
+	if err != nil {
+		return nil, err
+	}
+	if lo < first {
+		return nil, ErrCompacted
+	}
+	if hi > last+1 || lo > hi {
+		return nil, ErrUnavailable
+	}
+	var ents []Entry
+	var size uint64
+	for i := lo; i < hi; i++ {
+		data, err := s.wal.Read(i)
+		if err != nil {
+			return nil, err
+		}
+		size += uint64(len(data))
+		if len(ents) > 0 && size > maxSize {
+			break
+		}
+		var ent Entry
+		if err = decodeEntry(data, i, &ent); err != nil {
+			return nil, err
+		}
+		ents = append(ents, ent)
+	}
+	return ents, nil
+}
+
+// Term returns the term of entry i, which must be in the range
+// [FirstIndex()-1, LastIndex()].
+func (s *WALStorage) Term(i uint64) (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	first, last, err := s.indexes()
+	if err != nil {
+		return 0, err
+	}
+	if i < first-1 {
+		return 0, ErrCompacted
+	}
+	if i > last {
+		return 0, ErrUnavailable
+	}
+	return s.term(i), nil
+}
+
+func (s *WALStorage) term(i uint64) uint64 {
+	n := sort.Search(len(s.terms), func(k int) bool { return s.terms[k].index > i })
+	if n == 0 {
+		return 0
+	}
+	return s.terms[n-1].term
+}
+
+// LastIndex returns the index of the last entry in the log.
+func (s *WALStorage) LastIndex() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, last, err := s.indexes()
+	return last, err
+}
+
+// FirstIndex returns the index of the first log entry that is
+// possibly available via Entries.
+func (s *WALStorage) FirstIndex() (uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	first, _, err := s.indexes()
+	return first, err
+}
+
+func (s *WALStorage) indexes() (first, last uint64, err error) {
+	if first, err = s.wal.FirstIndex(); err != nil {
+		return
+	}
+	if last, err = s.wal.LastIndex(); err != nil {
+		return
+	}
+	if last < first-1 {
+		last = first - 1
+	}
+	return
+}
+
+// Snapshot returns the most recent snapshot.
+func (s *WALStorage) Snapshot() (Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.snapshot, nil
+}
+
+// ApplySnapshot overwrites the contents of this storage with the snapshot.
+func (s *WALStorage) ApplySnapshot(snap Snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if snap.Metadata.Index <= s.snapshot.Metadata.Index {
+		return ErrSnapOutOfDate
+	}
+	if err := s.writeSnapshot(snap); err != nil {
+		return err
+	}
+	if err := s.setConfState(snap.Metadata.ConfState); err != nil {
+		return err
+	}
+	s.terms = []termRun{{index: snap.Metadata.Index, term: snap.Metadata.Term}}
+	if err := s.writeTerms(); err != nil {
+		return err
+	}
+	return s.wal.ResetTo(snap.Metadata.Index + 1)
+}
+
+// CreateSnapshot makes a snapshot which can be retrieved with Snapshot() and
+// can be used to reconstruct the state at that point. If any configuration
+// changes have been made since the last compaction, the result of the last
+// ApplyConfChange must be passed in.
+func (s *WALStorage) CreateSnapshot(i uint64, cs *ConfState, data []byte) (Snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i <= s.snapshot.Metadata.Index {
+		return Snapshot{}, ErrSnapOutOfDate
+	}
+	first, last, err := s.indexes()
+	if err != nil {
+		return Snapshot{}, err
+	}
+	if i < first-1 {
+		return Snapshot{}, ErrCompacted
+	}
+	if i > last {
+		return Snapshot{}, ErrUnavailable
+	}
+	snap := Snapshot{Data: data, Metadata: SnapshotMetadata{Index: i, Term: s.term(i), ConfState: s.snapshot.Metadata.ConfState}}
+	if cs != nil {
+		snap.Metadata.ConfState = *cs
+	}
+	if err = s.writeSnapshot(snap); err != nil {
+		return Snapshot{}, err
+	}
+	return snap, nil
+}
+
+// Compact discards all log entries prior to compactIndex.
+// It is the application's responsibility to not attempt to compact an index
+// greater than the applied index.
+func (s *WALStorage) Compact(compactIndex uint64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	first, last, err := s.indexes()
+	if err != nil {
+		return err
+	}
+	if compactIndex <= first-1 {
+		return ErrCompacted
+	}
+	if compactIndex > last {
+		return ErrUnavailable
+	}
+	if compactIndex == last {
+		err = s.wal.ResetTo(last + 1)
+	} else {
+		err = s.wal.Clean(compactIndex + 1)
+	}
+	if err != nil {
+		return err
+	}
+	// The log may keep more entries than requested, so the terms are kept
+	// from the new first index on.
+	if first, _, err = s.indexes(); err != nil {
+		return err
+	}
+	n := sort.Search(len(s.terms), func(k int) bool { return s.terms[k].index > first-1 })
+	if n > 1 {
+		s.terms = append(s.terms[:0], s.terms[n-1:]...)
+		s.terms[0].index = first - 1
+		return s.writeTerms()
+	}
+	return nil
+}
+
+// Append appends the new entries to storage and commits them to stable storage.
+// The conflicting entries after the first new entry are discarded.
+func (s *WALStorage) Append(entries []Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(entries) == 0 {
+		return nil
+	}
+	first, last, err := s.indexes()
+	if err != nil {
+		return err
+	}
+	if entries[0].Index+uint64(len(entries))-1 < first {
+		return nil
+	}
+	if first > entries[0].Index {
+		entries = entries[first-entries[0].Index:]
+	}
+	offset := entries[0].Index
+	if offset > last+1 {
+		return ErrMissingEntries
+	}
+	changed := false
+	if offset <= last {
+		if offset == first {
+			err = s.wal.ResetTo(offset)
+		} else {
+			err = s.wal.Truncate(offset - 1)
+		}
+		if err != nil {
+			return err
+		}
+		changed = s.truncateTerms(offset)
+	}
+	for _, ent := range entries {
+		if s.terms[len(s.terms)-1].term != ent.Term {
+			s.terms = append(s.terms, termRun{index: ent.Index, term: ent.Term})
+			changed = true
+		}
+	}
+	if changed {
+		if err = s.writeTerms(); err != nil {
+			return err
+		}
+	}
+	for _, ent := range entries {
+		s.buf = encodeEntry(s.buf, &ent)
+		if err = s.wal.Write(ent.Index, s.buf); err != nil {
+			return err
+		}
+	}
+	if err = s.wal.Flush(); err != nil {
+		return err
+	}
+	return s.wal.Sync()
+}
+
+// truncateTerms removes the term runs from index on, but keeps the first run.
+func (s *WALStorage) truncateTerms(index uint64) bool {
+	n := sort.Search(len(s.terms), func(k int) bool { return s.terms[k].index >= index })
+	if n < 1 {
+		n = 1
+	}
+	if n < len(s.terms) {
+		s.terms = s.terms[:n]
+		return true
+	}
+	return false
+}
+
+// Close closes the storage.
+func (s *WALStorage) Close() error {
+	return s.wal.Close()
+}
+
+func (s *WALStorage) writeSnapshot(snap Snapshot) error {
+	e := &encoder{}
+	e.snapshot(snap)
+	if err := s.writeFile(snapshotFile, e.buf); err != nil {
+		return err
+	}
+	s.snapshot = snap
+	return nil
+}
+
+func (s *WALStorage) writeTerms() error {
+	e := &encoder{}
+	e.terms(s.terms)
+	return s.writeFile(termsFile, e.buf)
+}
+
+// writeFile replaces the file atomically, and syncs the directory so that
+// the rename is durable.
+func (s *WALStorage) writeFile(name string, data []byte) (err error) {
+	filePath := filepath.Join(s.path, name)
+	tmpPath := filePath + tmpSuffix
+	f, err := os.OpenFile(tmpPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC, s.fileMode)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmpPath, filePath); err != nil {
+		return err
+	}
+	return syncDir(s.path)
+}
+
+// syncDir commits the renames in the directory to stable storage.
+func syncDir(dir string) error {
+	if runtime.GOOS == "windows" {
+		// A directory can not be synced on windows.
+		return nil
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (s *WALStorage) readFile(name string, decode func(d *decoder)) error {
+	f, err := os.Open(filepath.Join(s.path, name))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	d := &decoder{buf: make([]byte, info.Size())}
+	if _, err = f.ReadAt(d.buf, 0); err != nil {
+		return err
+	}
+	decode(d)
+	return d.err
+}
@@ -0,0 +1,380 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package raftstorage
+
+import (
+	"github.com/hslam/wal"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testPath = "wal"
+
+// newTestStorage returns a storage with the entries, the first one is the
+// dummy entry at the snapshot index.
+func newTestStorage(t *testing.T, ents []Entry) *WALStorage {
+	os.RemoveAll(testPath)
+	s, err := Open(testPath, &wal.Options{SegmentEntries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ents) > 0 && ents[0].Index > 0 {
+		if err = s.ApplySnapshot(Snapshot{Metadata: SnapshotMetadata{Index: ents[0].Index, Term: ents[0].Term}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(ents) > 1 {
+		if err = s.Append(ents[1:]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return s
+}
+
+func reopen(t *testing.T, s *WALStorage) *WALStorage {
+	s.Close()
+	s, err := Open(testPath, &wal.Options{SegmentEntries: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func checkEntries(t *testing.T, s *WALStorage, ents []Entry) {
+	t.Helper()
+	first, _ := s.FirstIndex()
+	last, _ := s.LastIndex()
+	if first != ents[0].Index+1 || last != ents[len(ents)-1].Index {
+		t.Fatalf("first %d last %d, want %d %d", first, last, ents[0].Index+1, ents[len(ents)-1].Index)
+	}
+	for _, ent := range ents {
+		if term, err := s.Term(ent.Index); err != nil || term != ent.Term {
+			t.Fatalf("term(%d) = %d %v, want %d", ent.Index, term, err, ent.Term)
+		}
+	}
+	if len(ents) > 1 {
+		got, err := s.Entries(first, last+1, ^uint64(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, ents[1:]) {
+			t.Fatalf("entries = %v, want %v", got, ents[1:])
+		}
+	}
+}
+
+func TestStorageTerm(t *testing.T) {
+	ents := []Entry{{Index: 3, Term: 3}, {Index: 4, Term: 4}, {Index: 5, Term: 5}}
+	tests := []struct {
+		i    uint64
+		err  error
+		term uint64
+	}{
+		{2, ErrCompacted, 0},
+		{3, nil, 3},
+		{4, nil, 4},
+		{5, nil, 5},
+		{6, ErrUnavailable, 0},
+	}
+	s := newTestStorage(t, ents)
+	defer os.RemoveAll(testPath)
+	defer s.Close()
+	for i, tt := range tests {
+		term, err := s.Term(tt.i)
+		if err != tt.err {
+			t.Errorf("#%d: err = %v, want %v", i, err, tt.err)
+		}
+		if term != tt.term {
+			t.Errorf("#%d: term = %d, want %d", i, term, tt.term)
+		}
+	}
+}
+
+func TestStorageEntries(t *testing.T) {
+	ents := []Entry{{Index: 3, Term: 3}, {Index: 4, Term: 4, Data: []byte{4}}, {Index: 5, Term: 5, Data: []byte{5}}, {Index: 6, Term: 6, Data: []byte{6}}}
+	tests := []struct {
+		lo, hi, maxsize uint64
+		werr            error
+		wentries        []Entry
+	}{
+		{2, 6, ^uint64(0), ErrCompacted, nil},
+		{3, 4, ^uint64(0), ErrCompacted, nil},
+		{4, 5, ^uint64(0), nil, []Entry{{Index: 4, Term: 4, Data: []byte{4}}}},
+		{4, 6, ^uint64(0), nil, []Entry{{Index: 4, Term: 4, Data: []byte{4}}, {Index: 5, Term: 5, Data: []byte{5}}}},
+		{4, 7, ^uint64(0), nil, []Entry{{Index: 4, Term: 4, Data: []byte{4}}, {Index: 5, Term: 5, Data: []byte{5}}, {Index: 6, Term: 6, Data: []byte{6}}}},
+		// even if maxsize is zero, the first entry should be returned
+		{4, 7, 0, nil, []Entry{{Index: 4, Term: 4, Data: []byte{4}}}},
+		// limit to 2
+		{4, 7, 6, nil, []Entry{{Index: 4, Term: 4, Data: []byte{4}}, {Index: 5, Term: 5, Data: []byte{5}}}},
+		{4, 8, ^uint64(0), ErrUnavailable, nil},
+	}
+	s := newTestStorage(t, ents)
+	defer os.RemoveAll(testPath)
+	defer s.Close()
+	for i, tt := range tests {
+		entries, err := s.Entries(tt.lo, tt.hi, tt.maxsize)
+		if err != tt.werr {
+			t.Errorf("#%d: err = %v, want %v", i, err, tt.werr)
+		}
+		if !reflect.DeepEqual(entries, tt.wentries) {
+			t.Errorf("#%d: entries = %v, want %v", i, entries, tt.wentries)
+		}
+	}
+}
+
+func TestStorageCompact(t *testing.T) {
+	ents := []Entry{{Index: 3, Term: 3}, {Index: 4, Term: 4}, {Index: 5, Term: 5}}
+	tests := []struct {
+		i      uint64
+		werr   error
+		windex uint64
+		wterm  uint64
+		wlen   int
+	}{
+		{2, ErrCompacted, 3, 3, 3},
+		{3, ErrCompacted, 3, 3, 3},
+		{4, nil, 4, 4, 2},
+		{5, nil, 5, 5, 1},
+	}
+	for i, tt := range tests {
+		s := newTestStorage(t, ents)
+		if err := s.Compact(tt.i); err != tt.werr {
+			t.Errorf("#%d: err = %v, want %v", i, err, tt.werr)
+		}
+		s = reopen(t, s)
+		first, _ := s.FirstIndex()
+		last, _ := s.LastIndex()
+		if first-1 != tt.windex {
+			t.Errorf("#%d: index = %d, want %d", i, first-1, tt.windex)
+		}
+		if term, _ := s.Term(first - 1); term != tt.wterm {
+			t.Errorf("#%d: term = %d, want %d", i, term, tt.wterm)
+		}
+		if int(last-first+2) != tt.wlen {
+			t.Errorf("#%d: len = %d, want %d", i, last-first+2, tt.wlen)
+		}
+		s.Close()
+	}
+	os.RemoveAll(testPath)
+}
+
+func TestStorageCreateSnapshot(t *testing.T) {
+	ents := []Entry{{Index: 3, Term: 3}, {Index: 4, Term: 4}, {Index: 5, Term: 5}}
+	cs := &ConfState{Voters: []uint64{1, 2, 3}}
+	data := []byte("data")
+	tests := []struct {
+		i     uint64
+		werr  error
+		wsnap Snapshot
+	}{
+		{4, nil, Snapshot{Data: data, Metadata: SnapshotMetadata{Index: 4, Term: 4, ConfState: *cs}}},
+		{5, nil, Snapshot{Data: data, Metadata: SnapshotMetadata{Index: 5, Term: 5, ConfState: *cs}}},
+	}
+	for i, tt := range tests {
+		s := newTestStorage(t, ents)
+		snap, err := s.CreateSnapshot(tt.i, cs, data)
+		if err != tt.werr {
+			t.Errorf("#%d: err = %v, want %v", i, err, tt.werr)
+		}
+		if !reflect.DeepEqual(snap, tt.wsnap) {
+			t.Errorf("#%d: snap = %+v, want %+v", i, snap, tt.wsnap)
+		}
+		s = reopen(t, s)
+		if snap, _ = s.Snapshot(); !reflect.DeepEqual(snap, tt.wsnap) {
+			t.Errorf("#%d: snap = %+v, want %+v", i, snap, tt.wsnap)
+		}
+		if _, err = s.CreateSnapshot(tt.i, cs, data); err != ErrSnapOutOfDate {
+			t.Errorf("#%d: err = %v", i, err)
+		}
+		s.Close()
+	}
+	os.RemoveAll(testPath)
+}
+
+func TestStorageAppend(t *testing.T) {
+	ents := []Entry{{Index: 3, Term: 3}, {Index: 4, Term: 4}, {Index: 5, Term: 5}}
+	tests := []struct {
+		entries  []Entry
+		werr     error
+		wentries []Entry
+	}{
+		{
+			[]Entry{{Index: 1, Term: 1}, {Index: 2, Term: 2}},
+			nil,
+			[]Entry{{Index: 3, Term: 3}, {Index: 4, Term: 4}, {Index: 5, Term: 5}},
+		},
+		{
+			[]Entry{{Index: 3, Term: 3}, {Index: 4, Term: 4}, {Index: 5, Term: 5}},
+			nil,
+			[]Entry{{Index: 3, Term: 3}, {Index: 4, Term: 4}, {Index: 5, Term: 5}},
+		},
+		{
+			[]Entry{{Index: 3, Term: 3}, {Index: 4, Term: 6}, {Index: 5, Term: 6}},
+			nil,
+			[]Entry{{Index: 3, Term: 3}, {Index: 4, Term: 6}, {Index: 5, Term: 6}},
+		},
+		{
+			[]Entry{{Index: 3, Term: 3}, {Index: 4, Term: 4}, {Index: 5, Term: 5}, {Index: 6, Term: 5}},
+			nil,
+			[]Entry{{Index: 3, Term: 3}, {Index: 4, Term: 4}, {Index: 5, Term: 5}, {Index: 6, Term: 5}},
+		},
+		// truncate incoming entries, truncate the existing entries and append
+		{
+			[]Entry{{Index: 2, Term: 3}, {Index: 3, Term: 3}, {Index: 4, Term: 5}},
+			nil,
+			[]Entry{{Index: 3, Term: 3}, {Index: 4, Term: 5}},
+		},
+		// truncate the existing entries and append
+		{
+			[]Entry{{Index: 4, Term: 5}},
+			nil,
+			[]Entry{{Index: 3, Term: 3}, {Index: 4, Term: 5}},
+		},
+		// direct append
+		{
+			[]Entry{{Index: 6, Term: 5}},
+			nil,
+			[]Entry{{Index: 3, Term: 3}, {Index: 4, Term: 4}, {Index: 5, Term: 5}, {Index: 6, Term: 5}},
+		},
+		// missing entries
+		{
+			[]Entry{{Index: 7, Term: 5}},
+			ErrMissingEntries,
+			[]Entry{{Index: 3, Term: 3}, {Index: 4, Term: 4}, {Index: 5, Term: 5}},
+		},
+	}
+	for i, tt := range tests {
+		s := newTestStorage(t, ents)
+		if err := s.Append(tt.entries); err != tt.werr {
+			t.Errorf("#%d: err = %v, want %v", i, err, tt.werr)
+		}
+		checkEntries(t, s, tt.wentries)
+		s = reopen(t, s)
+		checkEntries(t, s, tt.wentries)
+		s.Close()
+	}
+	os.RemoveAll(testPath)
+}
+
+func TestStorageApplySnapshot(t *testing.T) {
+	cs := ConfState{Voters: []uint64{1, 2, 3}}
+	data := []byte("data")
+	s := newTestStorage(t, []Entry{{Index: 0}, {Index: 1, Term: 1}, {Index: 2, Term: 1}})
+	snap := Snapshot{Data: data, Metadata: SnapshotMetadata{Index: 4, Term: 4, ConfState: cs}}
+	if err := s.ApplySnapshot(snap); err != nil {
+		t.Fatal(err)
+	}
+	s = reopen(t, s)
+	checkEntries(t, s, []Entry{{Index: 4, Term: 4}})
+	if _, c, _ := s.InitialState(); !reflect.DeepEqual(c, cs) {
+		t.Fatal(c)
+	}
+	if got, _ := s.Snapshot(); !reflect.DeepEqual(got, snap) {
+		t.Fatal(got)
+	}
+	if err := s.Append([]Entry{{Index: 5, Term: 5}}); err != nil {
+		t.Fatal(err)
+	}
+	snap = Snapshot{Data: data, Metadata: SnapshotMetadata{Index: 3, Term: 3, ConfState: cs}}
+	if err := s.ApplySnapshot(snap); err != ErrSnapOutOfDate {
+		t.Fatal(err)
+	}
+	s.Close()
+	os.RemoveAll(testPath)
+}
+
+func TestStorageApplySnapshotInterrupted(t *testing.T) {
+	s := newTestStorage(t, []Entry{{Index: 0}, {Index: 1, Term: 1}, {Index: 2, Term: 1}, {Index: 3, Term: 1}, {Index: 4, Term: 1}})
+	// the terms are written but the log is not reset.
+	s.terms = []termRun{{index: 2, term: 2}}
+	if err := s.writeTerms(); err != nil {
+		t.Fatal(err)
+	}
+	s = reopen(t, s)
+	checkEntries(t, s, []Entry{{Index: 2, Term: 2}})
+	// the snapshot is written but the terms are not.
+	snap := Snapshot{Metadata: SnapshotMetadata{Index: 7, Term: 3}}
+	if err := s.writeSnapshot(snap); err != nil {
+		t.Fatal(err)
+	}
+	s = reopen(t, s)
+	checkEntries(t, s, []Entry{{Index: 7, Term: 3}})
+	s.Close()
+	os.RemoveAll(testPath)
+}
+
+func TestStorageHardState(t *testing.T) {
+	s := newTestStorage(t, nil)
+	st := HardState{Term: 3, Vote: 2, Commit: 10}
+	cs := ConfState{Voters: []uint64{1, 2}, Learners: []uint64{3}, AutoLeave: true}
+	if err := s.SetHardState(st); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetConfState(cs); err != nil {
+		t.Fatal(err)
+	}
+	s = reopen(t, s)
+	hs, c, err := s.InitialState()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hs != st || !reflect.DeepEqual(c, cs) {
+		t.Fatal(hs, c)
+	}
+	checkEntries(t, s, []Entry{{Index: 0}})
+	if err := s.Append([]Entry{{Index: 1, Term: 1}, {Index: 2, Term: 3}}); err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, s, []Entry{{Index: 0}, {Index: 1, Term: 1}, {Index: 2, Term: 3}})
+	s.Close()
+	os.RemoveAll(testPath)
+}
+
+func TestStorageInterface(t *testing.T) {
+	var _ Storage = &WALStorage{}
+}
+
+func TestStoragePermissions(t *testing.T) {
+	for _, mode := range []struct{ dir, file os.FileMode }{{0700, 0600}, {0750, 0640}} {
+		os.RemoveAll(testPath)
+		s, err := Open(testPath, &wal.Options{SegmentEntries: 2, DirMode: mode.dir, FileMode: mode.file})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = s.Append([]Entry{{Index: 1, Term: 1}, {Index: 2, Term: 2}}); err != nil {
+			t.Error(err)
+		}
+		if err = s.SetHardState(HardState{Term: 2, Vote: 1, Commit: 2}); err != nil {
+			t.Error(err)
+		}
+		if err = s.SetConfState(ConfState{Voters: []uint64{1}}); err != nil {
+			t.Error(err)
+		}
+		if _, err = s.CreateSnapshot(1, &ConfState{Voters: []uint64{1}}, []byte("data")); err != nil {
+			t.Error(err)
+		}
+		s.Close()
+		if info, err := os.Stat(testPath); err != nil || info.Mode().Perm() != mode.dir {
+			t.Error(info.Mode(), err)
+		}
+		infos, err := ioutil.ReadDir(testPath)
+		if err != nil {
+			t.Error(err)
+		}
+		for _, name := range []string{hardStateFile, confStateFile, snapshotFile, termsFile} {
+			if _, err := os.Stat(filepath.Join(testPath, name)); err != nil {
+				t.Error(err)
+			}
+		}
+		for _, info := range infos {
+			if info.Mode().Perm() != mode.file {
+				t.Error(info.Name(), info.Mode())
+			}
+		}
+	}
+	os.RemoveAll(testPath)
+}
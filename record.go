@@ -0,0 +1,387 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"github.com/hslam/code"
+	"time"
+)
+
+// A record is a varint size followed by size bytes. A plain record stores the
+// entry as is. When the size has the recordExtended bit, the record starts with
+// a varint of flags, then the fields of each flag in order, then the entry.
+// The fields of flagEncrypted are always the last, because they hold the entry.
+const recordExtended = 1 << 55
+
+// recordPadding is the size bit of a padding record, which fills the last block
+// written by direct I/O. The size is the number of padding bytes that follow.
+// A padding record is always at the end of a log file.
+const recordPadding = 1 << 54
+
+// paddingHeaderSize is the length of the header of a padding record.
+const paddingHeaderSize = 8
+
+const (
+	// flagCompressed is followed by the codec id.
+	flagCompressed = 1 << iota
+	// flagEncrypted is followed by the key id, the nonce and the encrypted data.
+	// The index, the flags and the fields before are authenticated as additional
+	// data, so a record can not be moved to another index.
+	flagEncrypted
+	// flagTxn is followed by the txn id and the txn record kind.
+	flagTxn
+	// flagHeader is followed by the length of the entry header and the header.
+	flagHeader
+	// flagTime is followed by the write time in unix nanoseconds.
+	flagTime
+	// flagKey is followed by the length of the key and the key. With
+	// flagEncrypted, the length of the key and the key are encrypted before
+	// the entry instead.
+	flagKey
+	// flagTombstone marks the deletion of the key.
+	flagTombstone
+	// flagCompacted marks a placeholder of an entry removed by compaction.
+	// It keeps only the write time if any.
+	flagCompacted
+
+	knownFlags = flagCompressed | flagEncrypted | flagTxn | flagHeader | flagTime |
+		flagKey | flagTombstone | flagCompacted
+)
+
+// entryHeaderVersion is the version of the entry header. The header is the
+// version, the type, the flags and the timestamp. A later version may only
+// append fields, so a header of an unknown version is read by the fields known.
+const entryHeaderVersion = 1
+
+// meta holds the fields of a record besides the entry.
+type meta struct {
+	codec     uint8
+	txn       uint64
+	txnKind   uint8
+	header    bool
+	typ       uint8
+	flags     uint64
+	timestamp int64
+	time      int64
+	key       []byte
+	tombstone bool
+	compacted bool
+}
+
+// recordSize returns the length of the record header and the record size.
+func recordSize(data []byte) (n int, size uint64) {
+	n = int(code.DecodeVarint(data, &size))
+	return n, size &^ recordExtended
+}
+
+// recordLength returns the length of the record at the beginning of data,
+// or zero if the record runs past the end of data.
+func recordLength(data []byte) int {
+	for i := 0; i < len(data) && i < 10; i++ {
+		if data[i] < 0x80 {
+			n, size := recordSize(data)
+			if size > uint64(len(data)-n) {
+				return 0
+			}
+			return n + int(size)
+		}
+	}
+	return 0
+}
+
+// paddingSize returns the length of the padding record at the beginning of data,
+// or zero if it is not a padding record.
+func paddingSize(data []byte) int {
+	if len(data) < paddingHeaderSize {
+		return 0
+	}
+	for i := 0; i < paddingHeaderSize-1; i++ {
+		if data[i] < 0x80 {
+			return 0
+		}
+	}
+	var size uint64
+	if data[paddingHeaderSize-1] >= 0x80 || code.DecodeVarint(data, &size) != paddingHeaderSize || size&recordPadding == 0 {
+		return 0
+	}
+	return paddingHeaderSize + int(size&^recordPadding)
+}
+
+// appendPadding fills buf with a padding record. The length of buf must not be
+// less than paddingHeaderSize.
+func appendPadding(buf []byte) {
+	code.EncodeVarint(buf, uint64(len(buf)-paddingHeaderSize)|recordPadding)
+	for i := paddingHeaderSize; i < len(buf); i++ {
+		buf[i] = 0
+	}
+}
+
+// encode encodes the entry data at index and the meta if any to a record.
+func (w *WAL) encode(index uint64, data []byte, m *meta) (entryData []byte, err error) {
+	var flags uint64
+	fields := w.fieldBuffer[:0]
+	if w.codec != nil && len(data) >= w.compressionThreshold {
+		var compressed []byte
+		if compressed, err = w.codec.Encode(w.compressBuffer[:0], data); err != nil {
+			return nil, err
+		}
+		w.compressBuffer = compressed[:0]
+		if len(compressed) < len(data) {
+			flags |= flagCompressed
+			fields = append(fields, w.codec.ID())
+			data = compressed
+		}
+	}
+	if m != nil && m.txn > 0 {
+		flags |= flagTxn
+		var buf [10]byte
+		fields = append(fields, buf[:code.EncodeVarint(buf[:], m.txn)]...)
+		fields = append(fields, m.txnKind)
+	}
+	if m != nil && m.header {
+		flags |= flagHeader
+		var buf [32]byte
+		buf[0], buf[1] = entryHeaderVersion, m.typ
+		n := 2 + code.EncodeVarint(buf[2:], m.flags)
+		n += code.EncodeVarint(buf[n:], uint64(m.timestamp<<1^m.timestamp>>63))
+		fields = append(fields, byte(n))
+		fields = append(fields, buf[:n]...)
+	}
+	if w.recordTime {
+		flags |= flagTime
+		fields = w.appendTime(fields)
+	}
+	if m != nil && m.key != nil {
+		flags |= flagKey
+		var buf [10]byte
+		key := append(buf[:code.EncodeVarint(buf[:], uint64(len(m.key)))], m.key...)
+		if w.cipher == nil {
+			fields = append(fields, key...)
+		} else {
+			data = append(key, data...)
+		}
+		if m.tombstone {
+			flags |= flagTombstone
+		}
+	}
+	if w.cipher != nil {
+		flags |= flagEncrypted
+		var buf [10]byte
+		additionalData := make([]byte, 0, 20+len(fields))
+		additionalData = append(additionalData, buf[:code.EncodeVarint(buf[:], index)]...)
+		additionalData = append(additionalData, buf[:code.EncodeVarint(buf[:], flags)]...)
+		additionalData = append(additionalData, fields...)
+		sealed, err := w.cipher.seal(w.sealBuffer[:0], data, additionalData)
+		if err != nil {
+			return nil, err
+		}
+		w.sealBuffer = sealed[:0]
+		data = sealed
+	}
+	w.fieldBuffer = fields[:0]
+	if flags == 0 {
+		w.encodeBuffer = code.CheckBuffer(w.encodeBuffer, uint64(10+len(data)))
+		n := code.EncodeVarint(w.encodeBuffer, uint64(len(data)))
+		n += uint64(copy(w.encodeBuffer[n:], data))
+		return w.encodeBuffer[:n], nil
+	}
+	size := code.SizeofVarint(flags) + uint64(len(fields)+len(data))
+	w.encodeBuffer = code.CheckBuffer(w.encodeBuffer, 10+size)
+	n := code.EncodeVarint(w.encodeBuffer, size|recordExtended)
+	n += code.EncodeVarint(w.encodeBuffer[n:], flags)
+	n += uint64(copy(w.encodeBuffer[n:], fields))
+	n += uint64(copy(w.encodeBuffer[n:], data))
+	return w.encodeBuffer[:n], nil
+}
+
+// appendTime appends the write time field, which is monotonic in the log.
+func (w *WAL) appendTime(fields []byte) []byte {
+	t := time.Now().UnixNano()
+	if t < w.lastTime {
+		t = w.lastTime
+	}
+	w.lastTime = t
+	var buf [10]byte
+	return append(fields, buf[:code.EncodeVarint(buf[:], uint64(t<<1^t>>63))]...)
+}
+
+// encodeHeader encodes the header of a record whose entry data of size bytes
+// follows the header, without compression and encryption.
+func (w *WAL) encodeHeader(size int) []byte {
+	if !w.recordTime {
+		w.encodeBuffer = code.CheckBuffer(w.encodeBuffer, 10)
+		return w.encodeBuffer[:code.EncodeVarint(w.encodeBuffer, uint64(size))]
+	}
+	var flags uint64 = flagTime
+	fields := w.appendTime(w.fieldBuffer[:0])
+	w.fieldBuffer = fields[:0]
+	w.encodeBuffer = code.CheckBuffer(w.encodeBuffer, uint64(20+len(fields)))
+	n := code.EncodeVarint(w.encodeBuffer, (code.SizeofVarint(flags)+uint64(len(fields)+size))|recordExtended)
+	n += code.EncodeVarint(w.encodeBuffer[n:], flags)
+	n += uint64(copy(w.encodeBuffer[n:], fields))
+	return w.encodeBuffer[:n]
+}
+
+// decode decodes the entry data and the meta if m is not nil from the record at index.
+func (w *WAL) decode(index uint64, entryData []byte, m *meta) (data []byte, err error) {
+	if m == nil {
+		m = &meta{}
+	}
+	flags, additionalData, data, err := decodeFields(entryData, m)
+	if err != nil {
+		return nil, err
+	}
+	if m.compacted {
+		return nil, ErrCompacted
+	}
+	var codec Codec
+	if flags&flagCompressed != 0 {
+		if codec = w.codecs[m.codec]; codec == nil {
+			return nil, ErrUnknownCodec
+		}
+	}
+	if flags&flagEncrypted != 0 {
+		if w.cipher == nil {
+			return nil, ErrNoCipher
+		}
+		var buf [10]byte
+		n := code.EncodeVarint(buf[:], index)
+		if data, err = w.cipher.open(data, append(buf[:n:n], additionalData...)); err != nil {
+			return nil, err
+		}
+		if flags&flagKey != 0 {
+			if data, err = m.decodeKey(data); err != nil {
+				return nil, err
+			}
+		}
+	}
+	if codec != nil {
+		return codec.Decode(nil, data)
+	}
+	return data, nil
+}
+
+// decodeFields decodes the fields of a record to the meta, and returns the
+// flags, the flags and the fields as the additional data, and the data left.
+func decodeFields(entryData []byte, m *meta) (flags uint64, additionalData, data []byte, err error) {
+	if len(entryData) == 0 {
+		return 0, nil, nil, ErrUnexpectedSize
+	}
+	var size uint64
+	n := int(code.DecodeVarint(entryData, &size))
+	if uint64(len(entryData)-n) != size&^recordExtended {
+		return 0, nil, nil, ErrUnexpectedSize
+	}
+	data = entryData[n:]
+	if size&recordExtended == 0 {
+		return 0, nil, data, nil
+	}
+	return decodeBody(data, m)
+}
+
+// decodeBody decodes the flags and the fields of the body of an extended record.
+// The body may be a prefix of the record that has the fields.
+func decodeBody(body []byte, m *meta) (flags uint64, additionalData, data []byte, err error) {
+	if len(body) == 0 {
+		return 0, nil, nil, ErrUnexpectedSize
+	}
+	data = body[code.DecodeVarint(body, &flags):]
+	if flags&^knownFlags != 0 {
+		return 0, nil, nil, ErrUnknownFlags
+	}
+	if flags&flagCompressed != 0 {
+		if len(data) == 0 {
+			return 0, nil, nil, ErrUnexpectedSize
+		}
+		m.codec = data[0]
+		data = data[1:]
+	}
+	if flags&flagTxn != 0 {
+		if len(data) == 0 {
+			return 0, nil, nil, ErrUnexpectedSize
+		}
+		data = data[code.DecodeVarint(data, &m.txn):]
+		if len(data) == 0 {
+			return 0, nil, nil, ErrUnexpectedSize
+		}
+		m.txnKind = data[0]
+		data = data[1:]
+	}
+	if flags&flagHeader != 0 {
+		if len(data) == 0 || len(data) < 1+int(data[0]) {
+			return 0, nil, nil, ErrUnexpectedSize
+		}
+		header := data[1 : 1+int(data[0])]
+		data = data[1+len(header):]
+		if err = m.decodeHeader(header); err != nil {
+			return 0, nil, nil, err
+		}
+	}
+	if flags&flagTime != 0 {
+		if len(data) == 0 {
+			return 0, nil, nil, ErrUnexpectedSize
+		}
+		var t uint64
+		data = data[code.DecodeVarint(data, &t):]
+		m.time = int64(t>>1) ^ -int64(t&1)
+	}
+	if flags&flagKey != 0 && flags&flagEncrypted == 0 {
+		if data, err = m.decodeKey(data); err != nil {
+			return 0, nil, nil, err
+		}
+	}
+	m.tombstone = flags&flagTombstone != 0
+	m.compacted = flags&flagCompacted != 0
+	return flags, body[:len(body)-len(data)], data, nil
+}
+
+// decodeKey decodes the length of the key and the key at the beginning of data,
+// and returns the data left.
+func (m *meta) decodeKey(data []byte) ([]byte, error) {
+	if len(data) == 0 {
+		return nil, ErrUnexpectedSize
+	}
+	var n uint64
+	data = data[code.DecodeVarint(data, &n):]
+	if n > uint64(len(data)) {
+		return nil, ErrUnexpectedSize
+	}
+	m.key = data[:n:n]
+	return data[n:], nil
+}
+
+// decodeHeader decodes the fields known of the entry header.
+func (m *meta) decodeHeader(header []byte) error {
+	if len(header) < 2 || header[0] < 1 {
+		return ErrUnexpectedSize
+	}
+	m.header, m.typ = true, header[1]
+	header = header[2:]
+	var timestamp uint64
+	for _, v := range []*uint64{&m.flags, &timestamp} {
+		if len(header) == 0 {
+			return ErrUnexpectedSize
+		}
+		header = header[code.DecodeVarint(header, v):]
+	}
+	m.timestamp = int64(timestamp>>1) ^ -int64(timestamp&1)
+	return nil
+}
+
+// appendPlaceholder appends a placeholder record of the entry to buf.
+func appendPlaceholder(buf []byte, m *meta) []byte {
+	var fields [32]byte
+	flags := uint64(flagCompacted)
+	n := uint64(0)
+	if m.time != 0 {
+		flags |= flagTime
+		n = code.EncodeVarint(fields[:], uint64(m.time<<1^m.time>>63))
+	}
+	size := code.SizeofVarint(flags) + n
+	var header [20]byte
+	h := code.EncodeVarint(header[:], size|recordExtended)
+	h += code.EncodeVarint(header[h:], flags)
+	buf = append(buf, header[:h]...)
+	return append(buf, fields[:n]...)
+}
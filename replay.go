@@ -0,0 +1,144 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"context"
+	"encoding/binary"
+	"hash/crc32"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// appliedName is the name of the applied index file.
+	appliedName = "APPLIED"
+	appliedTmp  = "APPLIED.tmp"
+)
+
+// AppliedIndex returns the applied index, zero if it has not been set.
+func (w *WAL) AppliedIndex() (index uint64, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, ErrClosed
+	}
+	return w.appliedIndex, nil
+}
+
+// SetAppliedIndex stores the applied index durably in the write-ahead log directory.
+// With the Retention option, it cleans the entries applied before the retained ones.
+func (w *WAL) SetAppliedIndex(index uint64) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	return w.setAppliedIndex(index)
+}
+
+func (w *WAL) setAppliedIndex(index uint64) (err error) {
+	if err = writeAppliedIndex(w.fs, w.path, index); err != nil {
+		return err
+	}
+	w.appliedIndex = index
+	if w.retention > 0 && index >= w.retention {
+		cleanIndex := index - w.retention + 1
+		if cleanIndex > w.firstIndex && cleanIndex <= w.lastIndex {
+			return w.clean(context.Background(), cleanIndex)
+		}
+	}
+	return nil
+}
+
+// writeAppliedIndex replaces the applied index file in the directory atomically.
+// It is the index and a crc32 checksum.
+func writeAppliedIndex(fs fileSystem, dir string, index uint64) error {
+	var buf [12]byte
+	binary.BigEndian.PutUint64(buf[:8], index)
+	binary.BigEndian.PutUint32(buf[8:], crc32.Checksum(buf[:8], crcTable))
+	return writeFile(fs, filepath.Join(dir, appliedTmp), filepath.Join(dir, appliedName), buf[:])
+}
+
+func (w *WAL) loadAppliedIndex() error {
+	f, err := w.fs.Open(filepath.Join(w.path, appliedName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer f.Close()
+	buf, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+	if len(buf) != 12 || crc32.Checksum(buf[:8], crcTable) != binary.BigEndian.Uint32(buf[8:]) {
+		return ErrUnexpectedSize
+	}
+	w.appliedIndex = binary.BigEndian.Uint64(buf[:8])
+	return nil
+}
+
+// Replay calls apply for each entry from the index on, and then sets the
+// applied index to the last entry applied if it is after the applied index.
+// If from is zero, it starts after the applied index. If apply returns an
+// error, the replay stops, the applied index is set to the last entry applied
+// successfully, and the error is returned.
+// The entries removed by compaction are skipped.
+//
+// The applied index is stored once the replay stops, so the entries may be
+// applied again after a crash during the replay.
+func (w *WAL) Replay(from uint64, apply func(index uint64, data []byte) error) (err error) {
+	w.mu.Lock()
+	err = w.flush()
+	if from == 0 {
+		from = w.appliedIndex + 1
+	}
+	first, last := w.firstIndex, w.lastIndex
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if from < first {
+		from = first
+	}
+	var applied uint64
+	for index := from; index <= last; index++ {
+		data, err := w.readMeta(index, nil)
+		if err == ErrCompacted {
+			applied = index
+			continue
+		} else if err != nil {
+			return w.replayed(applied, err)
+		}
+		if err = apply(index, data); err != nil {
+			return w.replayed(applied, err)
+		}
+		applied = index
+	}
+	return w.replayed(applied, nil)
+}
+
+// replayed sets the applied index if an entry after it is applied, and returns
+// the error of the replay if any. A replay from an index before the applied
+// index does not move the applied index backwards.
+func (w *WAL) replayed(applied uint64, err error) error {
+	if applied > 0 {
+		e := ErrClosed
+		w.mu.Lock()
+		if !w.closed {
+			e = nil
+			if applied > w.appliedIndex {
+				e = w.setAppliedIndex(applied)
+			}
+		}
+		w.mu.Unlock()
+		if err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestReplay(t *testing.T) {
+	file := "wal"
+	os.RemoveAll(file)
+	opts := &Options{SegmentEntries: 4, Retention: 3}
+	w, err := Open(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	entry := func(i uint64) []byte {
+		return []byte(fmt.Sprintf("entry-%d", i))
+	}
+	for i := uint64(1); i <= 10; i++ {
+		w.Write(i, entry(i))
+	}
+	if index, _ := w.AppliedIndex(); index != 0 {
+		t.Error(index)
+	}
+	errApply := errors.New("apply")
+	var applied []uint64
+	apply := func(index uint64, data []byte) error {
+		if string(data) != string(entry(index)) {
+			t.Error(index, string(data))
+		}
+		if index == 6 {
+			return errApply
+		}
+		applied = append(applied, index)
+		return nil
+	}
+	if err = w.Replay(0, apply); err != errApply {
+		t.Error(err)
+	}
+	if index, _ := w.AppliedIndex(); index != 5 {
+		t.Error(index)
+	}
+	// The entries applied before the last 3 are cleaned.
+	if index, _ := w.FirstIndex(); index != 3 {
+		t.Error(index)
+	}
+	w.Close()
+	w, err = Open(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	if index, _ := w.AppliedIndex(); index != 5 {
+		t.Error(index)
+	}
+	applied = applied[:0]
+	if err = w.Replay(0, func(index uint64, data []byte) error {
+		applied = append(applied, index)
+		return nil
+	}); err != nil {
+		t.Error(err)
+	}
+	if fmt.Sprint(applied) != "[6 7 8 9 10]" {
+		t.Error(applied)
+	}
+	if index, _ := w.AppliedIndex(); index != 10 {
+		t.Error(index)
+	}
+	if index, _ := w.FirstIndex(); index != 8 {
+		t.Error(index)
+	}
+	// Replay from an index does not skip the applied entries.
+	applied = applied[:0]
+	if err = w.Replay(9, func(index uint64, data []byte) error {
+		applied = append(applied, index)
+		return nil
+	}); err != nil {
+		t.Error(err)
+	}
+	if fmt.Sprint(applied) != "[9 10]" {
+		t.Error(applied)
+	}
+	// An error in a replay before the applied index does not move it backwards.
+	if err = w.Replay(8, func(index uint64, data []byte) error {
+		if index == 10 {
+			return errApply
+		}
+		return nil
+	}); err != errApply {
+		t.Error(err)
+	}
+	if index, _ := w.AppliedIndex(); index != 10 {
+		t.Error(index)
+	}
+	// Nothing to replay.
+	if err = w.Replay(0, apply); err != nil {
+		t.Error(err)
+	}
+	if err = w.SetAppliedIndex(7); err != nil {
+		t.Error(err)
+	}
+	w.Close()
+	w, err = Open(file, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if index, _ := w.AppliedIndex(); index != 7 {
+		t.Error(index)
+	}
+	w.Close()
+	os.RemoveAll(file)
+}
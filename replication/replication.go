@@ -0,0 +1,529 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+// Package replication streams the entries of a write-ahead log to followers.
+//
+// A follower connects to the leader and sends the last index and the checksum
+// of the last entry of its log. The leader truncates the follower's log until
+// its last entry matches, then streams the entries after it and follows the
+// tail of the log. When the requested entries have been cleaned, the leader
+// tells the follower to reset its log to the leader's first index. When the
+// leader's log has been truncated, the entries sent may have been rewritten,
+// so the leader checks the follower's last entry again.
+//
+// The records of the entries are copied unchanged by ReadRecord and WriteRecord,
+// so the follower's log is a byte-for-byte copy of the leader's, with the
+// transaction records, entry headers, keys, tombstones, write times and
+// compaction placeholders. The follower reads the entries with the same
+// Compression and Cipher options as the leader.
+package replication
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"github.com/hslam/wal"
+	"hash/crc32"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultPollInterval is the default interval to poll the tail of the log.
+const DefaultPollInterval = time.Millisecond * 10
+
+// DefaultRetryInterval is the default interval to reconnect to the leader.
+const DefaultRetryInterval = time.Millisecond * 100
+
+// maxEntrySize is the max size of a record accepted by a follower.
+const maxEntrySize = 1 << 32
+
+const (
+	msgEntry = iota + 1
+	msgReset
+	// msgTruncate asks the follower to truncate its log after the index, and
+	// to reply with the tail of its log.
+	msgTruncate
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+var (
+	// ErrClosed is returned when the server or the client is closed.
+	ErrClosed = errors.New("closed")
+	// ErrUnknownMessage is returned when the message type is unknown.
+	ErrUnknownMessage = errors.New("unknown message")
+	// ErrEntryTooLarge is returned when the entry size exceeds the limit.
+	ErrEntryTooLarge = errors.New("entry too large")
+)
+
+// Server streams the entries of a write-ahead log to followers.
+type Server struct {
+	// PollInterval is the interval to poll the tail of the log.
+	PollInterval time.Duration
+
+	wal       *wal.WAL
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	done      chan struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// NewServer returns a new server of the write-ahead log.
+func NewServer(w *wal.WAL) *Server {
+	return &Server{
+		PollInterval: DefaultPollInterval,
+		wal:          w,
+		listeners:    make(map[net.Listener]struct{}),
+		conns:        make(map[net.Conn]struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// Serve accepts connections on the listener and serves each follower in a new
+// goroutine. Serve always returns a non-nil error and closes the listener.
+// After Close, the returned error is ErrClosed.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return ErrClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.listeners, l)
+		s.mu.Unlock()
+	}()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosed() {
+				return ErrClosed
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go func() {
+			defer s.wg.Done()
+			s.serveConn(conn)
+			s.mu.Lock()
+			delete(s.conns, conn)
+			s.mu.Unlock()
+			conn.Close()
+		}()
+	}
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closed
+}
+
+func (s *Server) serveConn(conn net.Conn) error {
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	e := &encoder{w: w}
+	gen, err := s.wal.Generation()
+	if err != nil {
+		return err
+	}
+	next, err := s.verify(r, e)
+	if err != nil {
+		return err
+	}
+	for {
+		g, err := s.wal.Generation()
+		if err != nil {
+			return err
+		}
+		first, err := s.wal.FirstIndex()
+		if err != nil {
+			return err
+		}
+		last, err := s.wal.LastIndex()
+		if err != nil {
+			return err
+		}
+		if g != gen || last+1 < next {
+			// The log has been truncated, and the entries sent may have been rewritten.
+			gen = g
+			index := next - 1
+			if last < index {
+				index = last
+			}
+			if err = e.message(msgTruncate, index, nil); err != nil {
+				return err
+			}
+			if err = w.Flush(); err != nil {
+				return err
+			}
+			if next, err = s.verify(r, e); err != nil {
+				return err
+			}
+			continue
+		}
+		if next < first || last < first && next != first {
+			// The requested entries have been cleaned, or the log has been reset.
+			next = first
+			if err = e.message(msgReset, first, nil); err != nil {
+				return err
+			}
+		}
+		from := next
+		for ; next <= last; next++ {
+			record, err := s.wal.ReadRecord(next)
+			if err == io.EOF {
+				// The entry has not been flushed yet.
+				break
+			} else if err == wal.ErrOutOfRange {
+				// The log has been cleaned or truncated since.
+				break
+			} else if err != nil {
+				return err
+			}
+			if err = e.message(msgEntry, next, record); err != nil {
+				return err
+			}
+		}
+		if err = w.Flush(); err != nil {
+			return err
+		}
+		if next == from && !s.wait() {
+			return ErrClosed
+		}
+	}
+}
+
+// verify reads the tail of the follower's log, and truncates the follower's
+// log until its last entry matches the entry at the same index, stepping back
+// by a doubling distance. It returns the next index to send. The last entry of
+// the follower is not checked if it has been cleaned from the log. The records
+// are compared, so a compacted entry is checked by its placeholder.
+func (s *Server) verify(r *bufio.Reader, e *encoder) (next uint64, err error) {
+	step := uint64(1)
+	for {
+		last, sum, ok, err := readTail(r)
+		if err != nil {
+			return 0, err
+		}
+		if !ok {
+			return last + 1, nil
+		}
+		first, err := s.wal.FirstIndex()
+		if err != nil {
+			return 0, err
+		}
+		leaderLast, err := s.wal.LastIndex()
+		if err != nil {
+			return 0, err
+		}
+		if last < first {
+			return last + 1, nil
+		}
+		index := leaderLast
+		if last <= leaderLast {
+			record, err := s.wal.ReadRecord(last)
+			if err == nil && crc32.Checksum(record, crcTable) == sum {
+				return last + 1, nil
+			} else if err != nil && err != io.EOF && err != wal.ErrOutOfRange {
+				return 0, err
+			}
+			index = 0
+			if last > step {
+				index = last - step
+			}
+			step <<= 1
+		}
+		if index+1 < first {
+			if err = e.message(msgReset, first, nil); err != nil {
+				return 0, err
+			}
+			return first, e.w.Flush()
+		}
+		if err = e.message(msgTruncate, index, nil); err != nil {
+			return 0, err
+		}
+		if err = e.w.Flush(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// readTail reads the last index and the checksum of the record of the last
+// entry of the follower's log. It reports false if the log has no entries.
+func readTail(r *bufio.Reader) (last uint64, sum uint32, ok bool, err error) {
+	if last, err = binary.ReadUvarint(r); err != nil {
+		return
+	}
+	var buf [5]byte
+	if _, err = io.ReadFull(r, buf[:]); err != nil {
+		return
+	}
+	return last, binary.BigEndian.Uint32(buf[1:]), buf[0] != 0, nil
+}
+
+// wait waits for the poll interval and returns false if the server is closed.
+func (s *Server) wait() bool {
+	interval := s.PollInterval
+	if interval <= 0 {
+		interval = DefaultPollInterval
+	}
+	timer := time.NewTimer(interval)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-s.done:
+		return false
+	}
+}
+
+// Close closes the listeners and the connections, and waits for the
+// goroutines of the connections to exit.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	for l := range s.listeners {
+		l.Close()
+	}
+	for conn := range s.conns {
+		conn.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+// Client writes the records streamed by a leader to a local write-ahead log.
+type Client struct {
+	// RetryInterval is the interval to reconnect to the leader.
+	RetryInterval time.Duration
+
+	wal    *wal.WAL
+	mu     sync.Mutex
+	conn   net.Conn
+	done   chan struct{}
+	closed bool
+}
+
+// NewClient returns a new client of the local write-ahead log.
+func NewClient(w *wal.WAL) *Client {
+	return &Client{
+		RetryInterval: DefaultRetryInterval,
+		wal:           w,
+		done:          make(chan struct{}),
+	}
+}
+
+// Follow connects to the leader at the address on the named network and
+// replicates the log. It reconnects after a connection error and resumes after
+// the last index of the local log, until the client is closed.
+// After Close, the returned error is ErrClosed.
+func (c *Client) Follow(network, address string) error {
+	for {
+		conn, err := net.Dial(network, address)
+		if err == nil {
+			err = c.Replicate(conn)
+		}
+		if err == ErrClosed {
+			return err
+		}
+		interval := c.RetryInterval
+		if interval <= 0 {
+			interval = DefaultRetryInterval
+		}
+		timer := time.NewTimer(interval)
+		select {
+		case <-timer.C:
+		case <-c.done:
+			timer.Stop()
+			return ErrClosed
+		}
+	}
+}
+
+// Replicate replicates the log from the connection to the leader until an
+// error occurs. It closes the connection before returning.
+func (c *Client) Replicate(conn net.Conn) (err error) {
+	defer conn.Close()
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	c.conn = conn
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		c.conn = nil
+		if c.closed {
+			err = ErrClosed
+		}
+		c.mu.Unlock()
+	}()
+	if err = c.writeTail(conn); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	var data []byte
+	for {
+		if r.Buffered() == 0 {
+			// Make the applied entries durable before waiting for more.
+			if err = c.wal.Flush(); err != nil {
+				return err
+			}
+			if err = c.wal.Sync(); err != nil {
+				return err
+			}
+		}
+		t, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		index, err := binary.ReadUvarint(r)
+		if err != nil {
+			return err
+		}
+		switch t {
+		case msgEntry:
+			size, err := binary.ReadUvarint(r)
+			if err != nil {
+				return err
+			}
+			if size > maxEntrySize {
+				return ErrEntryTooLarge
+			}
+			if uint64(cap(data)) < size {
+				data = make([]byte, size)
+			}
+			data = data[:size]
+			if _, err = io.ReadFull(r, data); err != nil {
+				return err
+			}
+			if err = c.wal.WriteRecord(index, data); err != nil {
+				return err
+			}
+		case msgReset:
+			if err = c.wal.ResetTo(index); err != nil {
+				return err
+			}
+		case msgTruncate:
+			if err = c.truncate(index); err != nil {
+				return err
+			}
+			if err = c.writeTail(conn); err != nil {
+				return err
+			}
+		default:
+			return ErrUnknownMessage
+		}
+	}
+}
+
+// truncate discards the entries after the index.
+func (c *Client) truncate(index uint64) error {
+	first, err := c.wal.FirstIndex()
+	if err != nil {
+		return err
+	}
+	last, err := c.wal.LastIndex()
+	if err != nil {
+		return err
+	}
+	if index >= last {
+		return nil
+	} else if index < first {
+		return c.wal.ResetTo(index + 1)
+	}
+	return c.wal.Truncate(index)
+}
+
+// writeTail writes the last index and the checksum of the record of the last entry of the log.
+func (c *Client) writeTail(conn net.Conn) error {
+	if err := c.wal.Flush(); err != nil {
+		return err
+	}
+	first, err := c.wal.FirstIndex()
+	if err != nil {
+		return err
+	}
+	last, err := c.wal.LastIndex()
+	if err != nil {
+		return err
+	}
+	var buf [binary.MaxVarintLen64 + 5]byte
+	n := binary.PutUvarint(buf[:], last)
+	if last > 0 && last >= first {
+		record, err := c.wal.ReadRecord(last)
+		if err != nil {
+			return err
+		}
+		buf[n] = 1
+		binary.BigEndian.PutUint32(buf[n+1:], crc32.Checksum(record, crcTable))
+	}
+	_, err = conn.Write(buf[:n+5])
+	return err
+}
+
+// Close closes the connection to the leader and stops following.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	close(c.done)
+	if c.conn != nil {
+		c.conn.Close()
+	}
+	return nil
+}
+
+type encoder struct {
+	w   *bufio.Writer
+	buf [binary.MaxVarintLen64]byte
+}
+
+// message writes the type, the index and the data if any.
+func (e *encoder) message(t byte, index uint64, data []byte) (err error) {
+	if err = e.w.WriteByte(t); err != nil {
+		return err
+	}
+	if err = e.uvarint(index); err != nil {
+		return err
+	}
+	if t != msgEntry {
+		return nil
+	}
+	if err = e.uvarint(uint64(len(data))); err != nil {
+		return err
+	}
+	_, err = e.w.Write(data)
+	return err
+}
+
+func (e *encoder) uvarint(v uint64) error {
+	_, err := e.w.Write(e.buf[:binary.PutUvarint(e.buf[:], v)])
+	return err
+}
@@ -0,0 +1,433 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package replication
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/hslam/wal"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+func entry(i uint64) []byte {
+	return []byte(fmt.Sprintf("entry-%d", i))
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second * 5)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timeout")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// caughtUp returns a func that reports whether the follower has the same
+// range of entries with the leader.
+func caughtUp(leader, follower *wal.WAL) func() bool {
+	return func() bool {
+		first, _ := leader.FirstIndex()
+		last, _ := leader.LastIndex()
+		ffirst, _ := follower.FirstIndex()
+		flast, _ := follower.LastIndex()
+		return first == ffirst && last == flast
+	}
+}
+
+func checkEntries(t *testing.T, w *wal.WAL, first, last uint64) {
+	t.Helper()
+	if index, _ := w.FirstIndex(); index != first {
+		t.Errorf("first index %d, want %d", index, first)
+	}
+	if index, _ := w.LastIndex(); index != last {
+		t.Errorf("last index %d, want %d", index, last)
+	}
+	for i := first; i <= last; i++ {
+		if data, err := w.Read(i); err != nil {
+			t.Error(i, err)
+		} else if !bytes.Equal(data, entry(i)) {
+			t.Error(i, string(data))
+		}
+	}
+}
+
+func write(t *testing.T, w *wal.WAL, first, last uint64) {
+	t.Helper()
+	for i := first; i <= last; i++ {
+		if err := w.Write(i, entry(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	leaderPath, followerPath := "leader", "follower"
+	os.RemoveAll(leaderPath)
+	os.RemoveAll(followerPath)
+	defer os.RemoveAll(leaderPath)
+	defer os.RemoveAll(followerPath)
+	opts := &wal.Options{SegmentEntries: 4}
+	leader, err := wal.Open(leaderPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	follower, err := wal.Open(followerPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+	write(t, leader, 1, 10)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	server := NewServer(leader)
+	server.PollInterval = time.Millisecond
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(l) }()
+
+	client := NewClient(follower)
+	client.RetryInterval = time.Millisecond * 10
+	followed := make(chan error, 1)
+	go func() { followed <- client.Follow("tcp", addr) }()
+	waitFor(t, caughtUp(leader, follower))
+	checkEntries(t, follower, 1, 10)
+
+	// follow the tail
+	write(t, leader, 11, 20)
+	waitFor(t, caughtUp(leader, follower))
+	checkEntries(t, follower, 1, 20)
+
+	// truncate
+	if err = leader.Truncate(17); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, caughtUp(leader, follower))
+	checkEntries(t, follower, 1, 17)
+	write(t, leader, 18, 21)
+	waitFor(t, caughtUp(leader, follower))
+	checkEntries(t, follower, 1, 21)
+
+	// reconnect after the requested range has been cleaned
+	server.Close()
+	if err = <-served; err != ErrClosed {
+		t.Error(err)
+	}
+	write(t, leader, 22, 30)
+	if err = leader.Clean(25); err != nil {
+		t.Fatal(err)
+	}
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = NewServer(leader)
+	server.PollInterval = time.Millisecond
+	go func() { served <- server.Serve(l) }()
+	waitFor(t, caughtUp(leader, follower))
+	checkEntries(t, follower, 25, 30)
+
+	// reset
+	if err = leader.ResetTo(40); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, caughtUp(leader, follower))
+	write(t, leader, 40, 42)
+	waitFor(t, caughtUp(leader, follower))
+	checkEntries(t, follower, 40, 42)
+
+	client.Close()
+	if err = <-followed; err != ErrClosed {
+		t.Error(err)
+	}
+	server.Close()
+	if err = <-served; err != ErrClosed {
+		t.Error(err)
+	}
+	follower.Close()
+	follower, err = wal.Open(followerPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkEntries(t, follower, 40, 42)
+}
+
+func TestReplicationUnflushed(t *testing.T) {
+	leaderPath, followerPath := "leader", "follower"
+	os.RemoveAll(leaderPath)
+	os.RemoveAll(followerPath)
+	defer os.RemoveAll(leaderPath)
+	defer os.RemoveAll(followerPath)
+	leader, err := wal.Open(leaderPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	follower, err := wal.Open(followerPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+	server := NewServer(leader)
+	server.PollInterval = time.Millisecond
+	client := NewClient(follower)
+	a, b := net.Pipe()
+	go server.serveConn(a)
+	go client.Replicate(b)
+	for i := uint64(1); i <= 5; i++ {
+		leader.Write(i, entry(i))
+	}
+	time.Sleep(time.Millisecond * 20)
+	if last, _ := follower.LastIndex(); last != 0 {
+		t.Error(last)
+	}
+	leader.Flush()
+	waitFor(t, caughtUp(leader, follower))
+	client.Close()
+	server.Close()
+	checkEntries(t, follower, 1, 5)
+}
+
+// sameEntries returns a func that reports whether the follower has the same
+// records of the entries with the leader.
+func sameEntries(leader, follower *wal.WAL) func() bool {
+	return func() bool {
+		if !caughtUp(leader, follower)() {
+			return false
+		}
+		first, _ := leader.FirstIndex()
+		last, _ := leader.LastIndex()
+		for i := first; i <= last; i++ {
+			record, err := leader.ReadRecord(i)
+			if err != nil {
+				return false
+			}
+			if frecord, err := follower.ReadRecord(i); err != nil || !bytes.Equal(record, frecord) {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+func TestReplicationDivergence(t *testing.T) {
+	leaderPath, followerPath := "leader", "follower"
+	os.RemoveAll(leaderPath)
+	os.RemoveAll(followerPath)
+	defer os.RemoveAll(leaderPath)
+	defer os.RemoveAll(followerPath)
+	opts := &wal.Options{SegmentEntries: 4}
+	leader, err := wal.Open(leaderPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	follower, err := wal.Open(followerPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+	rewrite := func(index, last uint64, gen int) {
+		if index > 0 {
+			if err := leader.Truncate(index); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := index + 1; i <= last; i++ {
+			if err := leader.Write(i, []byte(fmt.Sprintf("entry-%d-%d", i, gen))); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := leader.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rewrite(0, 10, 0)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	server := NewServer(leader)
+	server.PollInterval = time.Millisecond * 20
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(l) }()
+	client := NewClient(follower)
+	client.RetryInterval = time.Millisecond * 10
+	followed := make(chan error, 1)
+	go func() { followed <- client.Follow("tcp", addr) }()
+	waitFor(t, sameEntries(leader, follower))
+
+	// truncate and rewrite past the next index between polls
+	rewrite(7, 12, 1)
+	waitFor(t, sameEntries(leader, follower))
+
+	// truncate and rewrite to the same last index while disconnected
+	server.Close()
+	if err = <-served; err != ErrClosed {
+		t.Error(err)
+	}
+	rewrite(2, 12, 2)
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = NewServer(leader)
+	server.PollInterval = time.Millisecond * 20
+	go func() { served <- server.Serve(l) }()
+	waitFor(t, sameEntries(leader, follower))
+
+	client.Close()
+	if err = <-followed; err != ErrClosed {
+		t.Error(err)
+	}
+	server.Close()
+	if err = <-served; err != ErrClosed {
+		t.Error(err)
+	}
+}
+
+func TestReplicationRecords(t *testing.T) {
+	leaderPath, followerPath := "leader", "follower"
+	os.RemoveAll(leaderPath)
+	os.RemoveAll(followerPath)
+	defer os.RemoveAll(leaderPath)
+	defer os.RemoveAll(followerPath)
+	opts := &wal.Options{SegmentEntries: 4, RecordTime: true}
+	leader, err := wal.Open(leaderPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	follower, err := wal.Open(followerPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+	txn, err := leader.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	txn.Write([]byte("a"))
+	txn.Abort()
+	leader.Write(4, []byte("b"))
+	leader.WriteEntry(5, &wal.Entry{Type: 1, Data: []byte("c")})
+	leader.WriteKey(6, []byte("key"), []byte("d"))
+	leader.Flush()
+
+	server := NewServer(leader)
+	server.PollInterval = time.Millisecond
+	client := NewClient(follower)
+	a, b := net.Pipe()
+	go server.serveConn(a)
+	go client.Replicate(b)
+	waitFor(t, caughtUp(leader, follower))
+	client.Close()
+	server.Close()
+	for i := uint64(1); i <= 6; i++ {
+		record, err := leader.ReadRecord(i)
+		if err != nil {
+			t.Error(i, err)
+		}
+		if frecord, err := follower.ReadRecord(i); err != nil || !bytes.Equal(record, frecord) {
+			t.Error(i, frecord, record, err)
+		}
+	}
+	var committed []string
+	follower.ReplayCommitted(1, func(index uint64, data []byte) error {
+		committed = append(committed, string(data))
+		return nil
+	})
+	if len(committed) != 3 || committed[0] != "b" {
+		t.Error(committed)
+	}
+}
+
+func TestReplicationCompacted(t *testing.T) {
+	leaderPath, followerPath := "leader", "follower"
+	os.RemoveAll(leaderPath)
+	os.RemoveAll(followerPath)
+	defer os.RemoveAll(leaderPath)
+	defer os.RemoveAll(followerPath)
+	opts := &wal.Options{SegmentEntries: 4}
+	leader, err := wal.Open(leaderPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer leader.Close()
+	follower, err := wal.Open(followerPath, opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer follower.Close()
+	for i := uint64(1); i <= 10; i++ {
+		leader.WriteKey(i, []byte("a"), entry(i))
+	}
+	// the entries 1..7 are replaced by placeholders
+	if err = leader.Compact(9); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	server := NewServer(leader)
+	server.PollInterval = time.Millisecond
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(l) }()
+	client := NewClient(follower)
+	client.RetryInterval = time.Millisecond * 10
+	followed := make(chan error, 1)
+	go func() { followed <- client.Follow("tcp", addr) }()
+	waitFor(t, sameEntries(leader, follower))
+	if _, err = follower.Read(1); err != wal.ErrCompacted {
+		t.Error(err)
+	}
+
+	// the last entry of the follower is a placeholder
+	if err = leader.Truncate(7); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, sameEntries(leader, follower))
+	server.Close()
+	if err = <-served; err != ErrClosed {
+		t.Error(err)
+	}
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = NewServer(leader)
+	server.PollInterval = time.Millisecond
+	go func() { served <- server.Serve(l) }()
+	leader.WriteKey(8, []byte("b"), entry(8))
+	leader.Flush()
+	waitFor(t, sameEntries(leader, follower))
+	if key, value, err := follower.ReadKey(8); err != nil || string(key) != "b" || !bytes.Equal(value, entry(8)) {
+		t.Error(string(key), string(value), err)
+	}
+
+	client.Close()
+	if err = <-followed; err != ErrClosed {
+		t.Error(err)
+	}
+	server.Close()
+	if err = <-served; err != ErrClosed {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,168 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"bytes"
+	"github.com/hslam/code"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// streamPrefixSize is the size of the prefix of a record read to find its entry data.
+const streamPrefixSize = 512
+
+// WriteFrom writes an entry of size bytes read from r. The entry is copied to
+// the active segment through a buffer, without holding it in memory, so it is
+// neither compressed nor batched. With a cipher or DirectIO, the entry is read
+// into memory and written by Write. It returns ErrEntryTooLarge if the record
+// of the entry is larger than the segment size.
+func (w *WAL) WriteFrom(index uint64, r io.Reader, size int64) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	if size < 0 {
+		return ErrUnexpectedSize
+	}
+	if w.cipher != nil || w.directIO {
+		if size > int64(w.segmentSize) {
+			return ErrEntryTooLarge
+		}
+		data := make([]byte, size)
+		if _, err = io.ReadFull(r, data); err != nil {
+			return err
+		}
+		return w.write(index, data, nil)
+	}
+	if index == 0 {
+		return ErrZeroIndex
+	}
+	if len(w.segments) > 0 && index != w.lastIndex+1 {
+		return ErrOutOfOrder
+	}
+	if size+int64(code.SizeofVarint(uint64(size))) > int64(w.segmentSize) {
+		return ErrEntryTooLarge
+	}
+	if len(w.segments) == 0 {
+		w.firstIndex = index
+		w.lastIndex = index - 1
+		if err = w.appendSegment(); err != nil {
+			return err
+		}
+	}
+	if err = w.flush(); err != nil {
+		return err
+	}
+	header := w.encodeHeader(int(size))
+	recordSize := int64(len(header)) + size
+	if recordSize > int64(w.segmentSize) {
+		return ErrEntryTooLarge
+	}
+	offset, err := w.lastSegment.logFile.Seek(0, os.SEEK_END)
+	if err != nil {
+		return err
+	}
+	if offset+recordSize > int64(w.segmentSize) || int(index-w.lastSegment.offset) > w.segmentEntries {
+		if err = w.sync(); err != nil {
+			return err
+		}
+		if err = w.appendSegment(); err != nil {
+			return err
+		}
+		offset = 0
+	}
+	logFile := w.lastSegment.logFile
+	if _, err = logFile.Write(header); err == nil {
+		var n int64
+		n, err = io.CopyBuffer(logFile, io.LimitReader(r, size), make([]byte, w.copyBufferSize))
+		if err == nil && n < size {
+			err = io.ErrUnexpectedEOF
+		}
+	}
+	if err != nil {
+		// Discard the partial record.
+		logFile.Truncate(offset)
+		logFile.Seek(offset, os.SEEK_SET)
+		return err
+	}
+	w.unsynced = true
+	entries := index - w.lastSegment.offset
+	code.EncodeUint64(w.lastSegment.indexBuffer, uint64(entries))
+	copy(w.lastSegment.indexMmap, w.lastSegment.indexBuffer)
+	code.EncodeUint64(w.lastSegment.indexBuffer, uint64(offset+recordSize))
+	copy(w.lastSegment.indexMmap[entries*8:entries*8+8], w.lastSegment.indexBuffer)
+	w.lastSegment.len = entries
+	w.lastIndex = index
+	return nil
+}
+
+// ReaderAt returns a reader of the entry data at index, which the caller must close.
+// The entry data without compression and encryption is read on demand from the
+// segment opened by the reader, so the reader is still valid after the segment
+// is closed by the log. Other entries are read into memory.
+func (w *WAL) ReaderAt(index uint64) (io.ReadCloser, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return nil, ErrClosed
+	}
+	if err := w.flush(); err != nil {
+		return nil, err
+	}
+	if err := w.checkIndex(index); err != nil {
+		return nil, err
+	}
+	s := w.segments[w.searchSegmentIndex(index)]
+	if err := w.loadSegment(s); err != nil {
+		return nil, err
+	}
+	start, end := s.readIndex(index)
+	prefix := make([]byte, streamPrefixSize)
+	if end-start < uint64(len(prefix)) {
+		prefix = prefix[:end-start]
+	}
+	f, err := w.fs.Open(s.logPath)
+	if err != nil {
+		return nil, err
+	}
+	if n, err := f.ReadAt(prefix, int64(start)); err != nil {
+		f.Close()
+		return nil, err
+	} else if n < len(prefix) || n == 0 {
+		f.Close()
+		return nil, ErrUnexpectedSize
+	}
+	var size uint64
+	n := code.DecodeVarint(prefix, &size)
+	offset := start + n
+	if size&recordExtended != 0 {
+		var m meta
+		flags, _, data, err := decodeBody(prefix[n:], &m)
+		if err != nil || flags&(flagCompressed|flagEncrypted|flagCompacted) != 0 {
+			// The fields are not in the prefix, or the entry data is encoded.
+			f.Close()
+			data, err := w.read(index, nil)
+			if err != nil {
+				return nil, err
+			}
+			return ioutil.NopCloser(bytes.NewReader(data)), nil
+		}
+		offset = start + uint64(len(prefix)-len(data))
+	}
+	return &sectionReadCloser{io.NewSectionReader(f, int64(offset), int64(end-offset)), f}, nil
+}
+
+// sectionReadCloser reads a section of a file, and closes the file.
+type sectionReadCloser struct {
+	*io.SectionReader
+	f file
+}
+
+// Close closes the file.
+func (r *sectionReadCloser) Close() error {
+	return r.f.Close()
+}
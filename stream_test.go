@@ -0,0 +1,160 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestEntryTooLarge(t *testing.T) {
+	file := "wal"
+	os.RemoveAll(file)
+	w, err := Open(file, &Options{SegmentSize: 1024})
+	if err != nil {
+		t.Error(err)
+	}
+	if err = w.Write(1, make([]byte, 1024)); err != ErrEntryTooLarge {
+		t.Error(err)
+	}
+	if err = w.WriteFrom(1, bytes.NewReader(make([]byte, 1024)), 1024); err != ErrEntryTooLarge {
+		t.Error(err)
+	}
+	if err = w.Write(1, make([]byte, 1021)); err != nil {
+		t.Error(err)
+	}
+	if err = w.Write(2, make([]byte, 1021)); err != nil {
+		t.Error(err)
+	}
+	if len(w.segments) != 2 {
+		t.Error(len(w.segments))
+	}
+	w.Close()
+	os.RemoveAll(file)
+}
+
+func TestWriteFrom(t *testing.T) {
+	file := "wal"
+	for _, opts := range []*Options{
+		{SegmentSize: 1 << 20},
+		{SegmentSize: 1 << 20, RecordTime: true, Compression: NewFlateCodec(flate.BestSpeed)},
+		{SegmentSize: 1 << 20, DirectIO: true},
+	} {
+		os.RemoveAll(file)
+		w, err := Open(file, opts)
+		if err != nil {
+			t.Error(err)
+		}
+		entry := func(i uint64) []byte {
+			return bytes.Repeat([]byte{byte(i)}, int(i)*100<<10)
+		}
+		for i := uint64(1); i <= 8; i++ {
+			if i%2 == 0 {
+				err = w.Write(i, entry(i))
+			} else {
+				err = w.WriteFrom(i, bytes.NewReader(entry(i)), int64(len(entry(i))))
+			}
+			if err != nil {
+				t.Error(i, err)
+			}
+		}
+		if err = w.WriteFrom(9, bytes.NewReader(entry(1)), int64(len(entry(1))+1)); err != io.ErrUnexpectedEOF {
+			t.Error(err)
+		}
+		if err = w.WriteFrom(9, bytes.NewReader(entry(9)), int64(len(entry(9)))); err != nil {
+			t.Error(err)
+		}
+		check := func() {
+			for i := uint64(1); i <= 9; i++ {
+				if data, err := w.Read(i); err != nil || !bytes.Equal(data, entry(i)) {
+					t.Error(i, len(data), err)
+				}
+				r, err := w.ReaderAt(i)
+				if err != nil {
+					t.Error(i, err)
+					continue
+				}
+				if data, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(data, entry(i)) {
+					t.Error(i, len(data), err)
+				}
+				r.Close()
+			}
+		}
+		check()
+		w.Close()
+		if w, err = Open(file, opts); err != nil {
+			t.Error(err)
+		}
+		check()
+		// the reader is still valid after the log is closed
+		r, err := w.ReaderAt(9)
+		if err != nil {
+			t.Error(err)
+		}
+		w.Close()
+		if data, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(data, entry(9)) {
+			t.Error(len(data), err)
+		}
+		r.Close()
+	}
+	os.RemoveAll(file)
+}
+
+func TestPartialRecord(t *testing.T) {
+	file := "wal"
+	os.RemoveAll(file)
+	opts := &Options{SegmentEntries: 16}
+	w, err := Open(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	for i := uint64(1); i <= 3; i++ {
+		w.WriteFrom(i, bytes.NewReader([]byte{byte(i)}), 1)
+	}
+	logPath := w.lastSegment.logPath
+	w.Close()
+	info, err := os.Stat(logPath)
+	if err != nil {
+		t.Error(err)
+	}
+	// a crash in WriteFrom leaves the header and a part of the entry
+	for _, tail := range [][]byte{{0x80}, {0x80, 0x08}, {0x80, 0x08, 1, 2, 3}} {
+		f, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0)
+		if err != nil {
+			t.Error(err)
+		}
+		f.Write(tail)
+		f.Close()
+		if w, err = Open(file, opts); err != nil {
+			t.Error(err)
+			continue
+		}
+		if last, _ := w.LastIndex(); last != 3 {
+			t.Error(last)
+		}
+		if info2, err := os.Stat(logPath); err != nil || info2.Size() != info.Size() {
+			t.Error(info2.Size(), info.Size(), err)
+		}
+		w.Close()
+	}
+	if w, err = Open(file, opts); err != nil {
+		t.Error(err)
+	}
+	w.Write(4, []byte{4})
+	w.Close()
+	if w, err = Open(file, opts); err != nil {
+		t.Error(err)
+	}
+	for i := uint64(1); i <= 4; i++ {
+		if data, err := w.Read(i); err != nil || !bytes.Equal(data, []byte{byte(i)}) {
+			t.Error(i, data, err)
+		}
+	}
+	w.Close()
+	os.RemoveAll(file)
+}
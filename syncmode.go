@@ -0,0 +1,37 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+// SyncMode is the mode to commit the active segment to stable storage.
+type SyncMode int
+
+const (
+	// SyncFsync commits the data and the metadata by fsync on Sync.
+	SyncFsync SyncMode = iota
+	// SyncFdatasync commits the data and only the metadata needed to read it
+	// by fdatasync on Sync. It falls back to fsync on the systems without fdatasync.
+	SyncFdatasync
+	// SyncDsync opens the segments with O_DSYNC, so every flush is durable
+	// and Sync does nothing more.
+	SyncDsync
+)
+
+// logFlag returns the flag to open the log file of a segment.
+func (w *WAL) logFlag() int {
+	if w.syncMode == SyncDsync {
+		return dsyncFlag
+	}
+	return 0
+}
+
+// syncFile commits the file to stable storage by the sync mode.
+func (w *WAL) syncFile(f file) error {
+	switch w.syncMode {
+	case SyncFdatasync:
+		return fdatasync(f)
+	case SyncDsync:
+		return nil
+	}
+	return f.Sync()
+}
@@ -0,0 +1,17 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package wal
+
+import (
+	"syscall"
+)
+
+const dsyncFlag = syscall.O_DSYNC
+
+func fdatasync(f file) error {
+	return syscall.Fdatasync(fd(f))
+}
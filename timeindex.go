@@ -0,0 +1,173 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"math"
+	"sort"
+	"time"
+)
+
+// timeIndexInterval is the number of entries between two samples of the time index.
+const timeIndexInterval = 64
+
+// timeSample is a sample of the sparse time index of a segment.
+type timeSample struct {
+	time  int64
+	index uint64
+}
+
+// IndexAt returns the index of the first entry written at or after t.
+// The write time is recorded with the RecordTime option, an entry written
+// without it is taken as written at the zero unix time. It returns ErrOutOfRange
+// if there is no such entry.
+func (w *WAL) IndexAt(t time.Time) (index uint64, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, ErrClosed
+	}
+	if err = w.flush(); err != nil {
+		return 0, err
+	}
+	if w.lastIndex == 0 || w.lastIndex < w.firstIndex {
+		return 0, ErrOutOfRange
+	}
+	ts := t.UnixNano()
+	low := 0
+	high := len(w.segments) - 1
+	for low <= high {
+		mid := (low + high) / 2
+		first, err := w.segmentTime(w.segments[mid])
+		if err != nil {
+			return 0, err
+		}
+		if first < ts {
+			low = mid + 1
+		} else {
+			high = mid - 1
+		}
+	}
+	// high is the last segment whose first entry is written before t.
+	if high < 0 {
+		return w.firstIndex, nil
+	}
+	s := w.segments[high]
+	if index, err = w.searchTime(s, ts); err != nil || index > 0 {
+		if index > 0 && index < w.firstIndex {
+			// The entry has been cleaned logically.
+			index = w.firstIndex
+		}
+		return index, err
+	}
+	if high+1 < len(w.segments) && w.segments[high+1].len > 0 {
+		return w.segments[high+1].offset + 1, nil
+	}
+	return 0, ErrOutOfRange
+}
+
+// segmentTime returns the write time of the first entry of the segment,
+// which is the first sample of the time index.
+func (w *WAL) segmentTime(s *segment) (int64, error) {
+	if len(s.times) > 0 {
+		return s.times[0].time, nil
+	}
+	if err := w.loadSegment(s); err != nil {
+		return 0, err
+	}
+	if s.len == 0 {
+		return math.MaxInt64, nil
+	}
+	t, err := w.readTime(s, s.offset+1)
+	if err != nil {
+		return 0, err
+	}
+	s.times = append(s.times, timeSample{time: t, index: s.offset + 1})
+	return t, nil
+}
+
+// searchTime returns the index of the first entry written at or after ts in
+// the segment, or zero if there is no such entry.
+func (w *WAL) searchTime(s *segment, ts int64) (uint64, error) {
+	if err := w.loadTimes(s); err != nil {
+		return 0, err
+	}
+	k := sort.Search(len(s.times), func(i int) bool { return s.times[i].time >= ts })
+	if k == 0 {
+		if len(s.times) > 0 {
+			return s.times[0].index, nil
+		}
+		return 0, nil
+	}
+	end := s.offset + s.len
+	if k < len(s.times) {
+		end = s.times[k].index - 1
+	}
+	for index := s.times[k-1].index + 1; index <= end; index++ {
+		t, err := w.readTime(s, index)
+		if err != nil {
+			return 0, err
+		}
+		if t >= ts {
+			return index, nil
+		}
+	}
+	if k < len(s.times) {
+		return s.times[k].index, nil
+	}
+	return 0, nil
+}
+
+// loadTimes samples the write time of every timeIndexInterval entries of the
+// segment that are not sampled yet.
+func (w *WAL) loadTimes(s *segment) (err error) {
+	if err = w.loadSegment(s); err != nil {
+		return err
+	}
+	next := s.offset + 1
+	if len(s.times) > 0 {
+		next = s.times[len(s.times)-1].index + timeIndexInterval
+	}
+	for ; next <= s.offset+s.len; next += timeIndexInterval {
+		t, err := w.readTime(s, next)
+		if err != nil {
+			return err
+		}
+		s.times = append(s.times, timeSample{time: t, index: next})
+	}
+	return nil
+}
+
+// loadLastTime loads the write time of the last entry, so the write time stays
+// monotonic after the log is reopened.
+func (w *WAL) loadLastTime() error {
+	for i := len(w.segments) - 1; i >= 0; i-- {
+		s := w.segments[i]
+		if err := w.loadSegment(s); err != nil {
+			return err
+		}
+		if s.len > 0 {
+			t, err := w.readTime(s, s.offset+s.len)
+			if err != nil {
+				return err
+			}
+			w.lastTime = t
+			return nil
+		}
+	}
+	return nil
+}
+
+// readTime returns the write time of the entry in the segment.
+func (w *WAL) readTime(s *segment, index uint64) (int64, error) {
+	entryData, err := s.readRecord(index)
+	if err != nil {
+		return 0, err
+	}
+	var m meta
+	if _, _, _, err = decodeFields(entryData, &m); err != nil {
+		return 0, err
+	}
+	return m.time, nil
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"bytes"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestIndexAt(t *testing.T) {
+	file := "wal"
+	os.RemoveAll(file)
+	keys := &testKeys{current: 1, keys: map[uint64][]byte{1: bytes.Repeat([]byte{1}, 16)}}
+	opts := &Options{SegmentEntries: 100, RecordTime: true, Cipher: NewCipher(keys)}
+	w, err := Open(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	if _, err = w.IndexAt(time.Now()); err != ErrOutOfRange {
+		t.Error(err)
+	}
+	n := uint64(300)
+	times := make([]time.Time, n+1)
+	for i := uint64(1); i <= n; i++ {
+		times[i] = time.Now()
+		w.Write(i, []byte("Hello World"))
+		time.Sleep(time.Microsecond)
+	}
+	check := func(first, last uint64) {
+		for i := uint64(1); i <= n; i++ {
+			index, err := w.IndexAt(times[i])
+			if i > last {
+				if err != ErrOutOfRange {
+					t.Error(i, index, err)
+				}
+			} else if err != nil {
+				t.Error(i, err)
+			} else if i < first && index != first || i >= first && index != i {
+				t.Error(i, index)
+			}
+		}
+		if index, err := w.IndexAt(times[1].Add(-time.Hour)); err != nil || index != first {
+			t.Error(index, err)
+		}
+		if _, err := w.IndexAt(time.Now()); err != ErrOutOfRange {
+			t.Error(err)
+		}
+	}
+	check(1, n)
+	lastTime := w.lastTime
+	w.Close()
+	w, err = Open(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	if w.lastTime != lastTime {
+		t.Error(w.lastTime, lastTime)
+	}
+	if _, err = w.segmentTime(w.segments[1]); err != nil || len(w.segments[1].times) != 1 {
+		t.Error(len(w.segments[1].times), err)
+	}
+	check(1, n)
+	if err = w.Clean(50); err != nil {
+		t.Error(err)
+	}
+	check(50, n)
+	if err = w.Truncate(250); err != nil {
+		t.Error(err)
+	}
+	check(50, 250)
+	if err = w.Truncate(200); err != nil {
+		t.Error(err)
+	}
+	check(50, 200)
+	w.Close()
+	os.RemoveAll(file)
+}
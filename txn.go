@@ -0,0 +1,167 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+const (
+	txnData = iota
+	txnBegin
+	txnCommit
+	txnAbort
+)
+
+// Txn represents a transaction of entries. The entries of transactions may be
+// interleaved with each other and with the entries not in a transaction.
+type Txn struct {
+	w    *WAL
+	id   uint64
+	done bool
+}
+
+// Begin writes a begin record to buffer and returns a new transaction.
+// The index of the begin record is the txn id.
+func (w *WAL) Begin() (txn *Txn, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	index := w.lastIndex + 1
+	if err = w.write(index, nil, &meta{txn: index, txnKind: txnBegin}); err != nil {
+		return nil, err
+	}
+	return &Txn{w: w, id: index}, nil
+}
+
+// ID returns the txn id.
+func (txn *Txn) ID() uint64 {
+	return txn.id
+}
+
+// Write writes an entry of the transaction to buffer at the next index and returns the index.
+func (txn *Txn) Write(data []byte) (index uint64, err error) {
+	return txn.write(data, txnData)
+}
+
+// Commit writes a commit record to buffer. Like the entries, the commit record
+// is durable after Flush and Sync.
+func (txn *Txn) Commit() (err error) {
+	_, err = txn.write(nil, txnCommit)
+	return
+}
+
+// Abort writes an abort record to buffer.
+func (txn *Txn) Abort() (err error) {
+	_, err = txn.write(nil, txnAbort)
+	return
+}
+
+func (txn *Txn) write(data []byte, kind uint8) (index uint64, err error) {
+	w := txn.w
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if txn.done {
+		return 0, ErrTxnDone
+	}
+	index = w.lastIndex + 1
+	if err = w.write(index, data, &meta{txn: txn.id, txnKind: kind}); err != nil {
+		return 0, err
+	}
+	if kind != txnData {
+		txn.done = true
+	}
+	return index, nil
+}
+
+type txnEntry struct {
+	index uint64
+	data  []byte
+}
+
+// ReplayCommitted calls fn for each entry from the index on, except the entries
+// of the transactions that are aborted or not committed. The entries of a
+// transaction are delivered in index order when its commit record is read, so
+// the transactions are delivered in commit order. The entries not in a
+// transaction are delivered when they are read. If fn returns an error, the
+// replay stops and returns the error.
+//
+// The entries of a transaction begun before the index are read from its begin
+// record, or from the first index if it has been cleaned.
+func (w *WAL) ReplayCommitted(from uint64, fn func(index uint64, data []byte) error) (err error) {
+	w.mu.Lock()
+	err = w.flush()
+	first, last := w.firstIndex, w.lastIndex
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if from < first {
+		from = first
+	}
+	txns := make(map[uint64][]txnEntry)
+	for index := from; index <= last; index++ {
+		var m meta
+		data, err := w.readMeta(index, &m)
+		if err == ErrCompacted {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if m.txn == 0 {
+			if err = fn(index, data); err != nil {
+				return err
+			}
+			continue
+		}
+		switch m.txnKind {
+		case txnData:
+			txns[m.txn] = append(txns[m.txn], txnEntry{index: index, data: data})
+		case txnCommit:
+			entries := txns[m.txn]
+			delete(txns, m.txn)
+			if m.txn < from {
+				var begun []txnEntry
+				if begun, err = w.readTxn(m.txn, from); err != nil {
+					return err
+				}
+				entries = append(begun, entries...)
+			}
+			for _, e := range entries {
+				if err = fn(e.index, e.data); err != nil {
+					return err
+				}
+			}
+		case txnAbort:
+			delete(txns, m.txn)
+		}
+	}
+	return nil
+}
+
+// readTxn reads the entries of the transaction before the index.
+func (w *WAL) readTxn(id, to uint64) (entries []txnEntry, err error) {
+	first, err := w.FirstIndex()
+	if err != nil {
+		return nil, err
+	}
+	start := id
+	if start < first {
+		start = first
+	}
+	for index := start; index < to; index++ {
+		var m meta
+		data, err := w.readMeta(index, &m)
+		if err == ErrCompacted {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if m.txn == id && m.txnKind == txnData {
+			entries = append(entries, txnEntry{index: index, data: data})
+		}
+	}
+	return entries, nil
+}
+
+func (w *WAL) readMeta(index uint64, m *meta) (data []byte, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.read(index, m)
+}
@@ -0,0 +1,106 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestTxn(t *testing.T) {
+	keys := &testKeys{current: 1, keys: map[uint64][]byte{1: bytes.Repeat([]byte{1}, 16)}}
+	for _, opts := range []*Options{
+		{SegmentEntries: 4},
+		{SegmentEntries: 4, Compression: NewFlateCodec(flate.BestSpeed), CompressionThreshold: 1, Cipher: NewCipher(keys)},
+	} {
+		testTxn(t, opts)
+	}
+}
+
+func testTxn(t *testing.T, opts *Options) {
+	file := "wal"
+	os.RemoveAll(file)
+	w, err := Open(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	entry := func(name string, i int) []byte {
+		return bytes.Repeat([]byte(fmt.Sprintf("%s-%d", name, i)), 4)
+	}
+	t1, _ := w.Begin()
+	t2, _ := w.Begin()
+	t3, _ := w.Begin()
+	t4, _ := w.Begin()
+	if t1.ID() != 1 || t2.ID() != 2 {
+		t.Error(t1.ID(), t2.ID())
+	}
+	var want []string
+	for i := 0; i < 3; i++ {
+		t1.Write(entry("t1", i))
+		t2.Write(entry("t2", i))
+		t3.Write(entry("t3", i))
+		t4.Write(entry("t4", i))
+		w.Append(entry("plain", i))
+		want = append(want, string(entry("plain", i)))
+	}
+	t2.Commit()
+	for i := 0; i < 3; i++ {
+		want = append(want, string(entry("t2", i)))
+	}
+	t3.Abort()
+	t1.Commit()
+	for i := 0; i < 3; i++ {
+		want = append(want, string(entry("t1", i)))
+	}
+	if _, err = t1.Write(nil); err != ErrTxnDone {
+		t.Error(err)
+	}
+	if err = t3.Commit(); err != ErrTxnDone {
+		t.Error(err)
+	}
+	replay := func(from uint64) (got []string) {
+		err := w.ReplayCommitted(from, func(index uint64, data []byte) error {
+			got = append(got, string(data))
+			if data, err := w.Read(index); err != nil || string(data) != got[len(got)-1] {
+				t.Error(index, err)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		return
+	}
+	check := func(got, want []string) {
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	check(replay(1), want)
+	w.Close()
+	w, err = Open(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	check(replay(1), want)
+	// t1 and t2 are begun before the index 10.
+	check(replay(10), want[1:])
+	w.Clean(2)
+	check(replay(1), want)
+	stop := errors.New("stop")
+	var n int
+	err = w.ReplayCommitted(1, func(index uint64, data []byte) error {
+		n++
+		return stop
+	})
+	if err != stop || n != 1 {
+		t.Error(err, n)
+	}
+	w.Close()
+	os.RemoveAll(file)
+}
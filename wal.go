@@ -5,10 +5,13 @@
 package wal
 
 import (
+	"compress/flate"
+	"context"
 	"errors"
 	"fmt"
 	"github.com/hslam/code"
 	"github.com/hslam/mmap"
+	"io"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -24,8 +27,16 @@ const (
 	DefaultWriteBufferSize = 1024 * 1024
 	// DefaultEncodeBufferSize is the default encode buffer size.
 	DefaultEncodeBufferSize = 1024 * 64
+	// DefaultCopyBufferSize is the default copy buffer size.
+	DefaultCopyBufferSize = 1024 * 1024
 	// DefaultBase is the default base.
 	DefaultBase = 10
+	// DefaultCompressionThreshold is the default compression threshold.
+	DefaultCompressionThreshold = 256
+	// DefaultDirMode is the default permission of the directory.
+	DefaultDirMode os.FileMode = 0744
+	// DefaultFileMode is the default permission of the files.
+	DefaultFileMode os.FileMode = 0666
 )
 
 const (
@@ -51,38 +62,99 @@ var (
 	ErrOutOfOrder = errors.New("out of order")
 	// ErrBase is returned when base < 2 or base > 36
 	ErrBase = errors.New("2 <= base <= 36")
+	// ErrUnknownCodec is returned when the codec of a compressed entry is unknown.
+	ErrUnknownCodec = errors.New("unknown codec")
+	// ErrUnknownFlags is returned when a record has unknown flags.
+	ErrUnknownFlags = errors.New("unknown flags")
+	// ErrNoCipher is returned when reading an encrypted entry without a cipher.
+	ErrNoCipher = errors.New("no cipher")
+	// ErrBadManifest is returned when the manifest is corrupt.
+	ErrBadManifest = errors.New("bad manifest")
+	// ErrBadCheckpoint is returned when the checkpoint does not match its manifest.
+	ErrBadCheckpoint = errors.New("bad checkpoint")
+	// ErrTxnDone is returned when the transaction has been committed or aborted.
+	ErrTxnDone = errors.New("transaction has been committed or aborted")
+	// ErrCompacted is returned when the entry has been removed by compaction.
+	ErrCompacted = errors.New("compacted")
+	// ErrInvalidName is returned when the name of a managed log is not a valid directory name.
+	ErrInvalidName = errors.New("invalid name")
+	// ErrCanceled is returned when the context is canceled or its deadline is exceeded
+	// before the operation takes effect.
+	ErrCanceled = errors.New("canceled")
+	// ErrSyncMode is returned when the sync mode is unknown.
+	ErrSyncMode = errors.New("unknown sync mode")
+	// ErrEntryTooLarge is returned when the record of an entry is larger than the segment size.
+	ErrEntryTooLarge = errors.New("entry too large")
+	// ErrDiscarded is returned by the future of an entry discarded by Truncate, Reset or ResetTo
+	// before it has been synced.
+	ErrDiscarded = errors.New("discarded")
 )
 
 // WAL represents a write-ahead log.
+// It is safe for concurrent use by multiple goroutines.
 type WAL struct {
-	path           string
-	segmentSize    int
-	segmentEntries int
-	indexSpace     int
-	logSuffix      string
-	indexSuffix    string
-	base           int
-	noSplitSegment bool
-	nameLength     int
-	closed         bool
-	segments       []*segment
-	firstIndex     uint64
-	lastIndex      uint64
-	lastSegment    *segment
-	encodeBuffer   []byte
-	writeBuffer    []byte
+	mu                   mutex
+	fs                   fileSystem
+	path                 string
+	segmentSize          int
+	segmentEntries       int
+	indexSpace           int
+	logSuffix            string
+	indexSuffix          string
+	base                 int
+	noSplitSegment       bool
+	logicalClean         bool
+	mmapCopy             bool
+	copyBufferSize       int
+	directIO             bool
+	noCopy               bool
+	vectors              []vector
+	retainedSize         int
+	syncMode             SyncMode
+	directOffset         int64
+	tail                 int
+	nameLength           int
+	closed               bool
+	segments             []*segment
+	firstIndex           uint64
+	lastIndex            uint64
+	generation           uint64
+	lastSegment          *segment
+	encodeBuffer         []byte
+	writeBuffer          []byte
+	fieldBuffer          []byte
+	codec                Codec
+	codecs               map[uint8]Codec
+	compressBuffer       []byte
+	cipher               *Cipher
+	sealBuffer           []byte
+	compressionThreshold int
+	recordTime           bool
+	lastTime             int64
+	appliedIndex         uint64
+	retention            uint64
+	budget               *memoryBudget
+	dirMode              os.FileMode
+	fileMode             os.FileMode
+	unsynced             bool
+	futures              []*Future
+	commitCh             chan struct{}
+	commitDone           chan struct{}
 }
 
 type segment struct {
+	fs          fileSystem
 	logPath     string
 	indexPath   string
 	indexSpace  int
 	offset      uint64
 	len         uint64
-	indexFile   *os.File
+	indexFile   file
 	indexMmap   []byte
-	logFile     *os.File
+	logFile     file
+	directFile  file
 	indexBuffer []byte
+	times       []timeSample
 }
 
 func (s *segment) readIndex(index uint64) (start, end uint64) {
@@ -100,18 +172,31 @@ func (s *segment) readIndex(index uint64) (start, end uint64) {
 	return
 }
 
+// readRecord reads the record by index. It does not move the file offset,
+// which is at the end of the active segment for the buffered data.
+func (s *segment) readRecord(index uint64) ([]byte, error) {
+	start, end := s.readIndex(index)
+	entryData := make([]byte, end-start)
+	n, err := s.logFile.ReadAt(entryData, int64(start))
+	if err != nil {
+		return nil, err
+	}
+	if len(entryData) != n {
+		return nil, ErrUnexpectedSize
+	}
+	return entryData, nil
+}
+
 func (s *segment) load() error {
 	var err error
 	if s.indexFile == nil {
-		if s.indexFile, err = os.Create(s.indexPath); err != nil {
+		if s.indexFile, err = s.fs.Create(s.indexPath); err != nil {
 			return err
 		}
-		if mmap.Fsize(s.indexFile) != s.indexSpace {
-			if err = s.indexFile.Truncate(int64(s.indexSpace)); err != nil {
-				return err
-			}
+		if err = s.indexFile.Truncate(int64(s.indexSpace)); err != nil {
+			return err
 		}
-		if s.indexMmap, err = mmap.Open(mmap.Fd(s.indexFile), 0, mmap.Fsize(s.indexFile), mmap.READ|mmap.WRITE); err != nil {
+		if s.indexMmap, err = mmap.Open(fd(s.indexFile), 0, s.indexSpace, mmap.READ|mmap.WRITE); err != nil {
 			return err
 		}
 	}
@@ -121,12 +206,23 @@ func (s *segment) load() error {
 	var size uint64
 	code.DecodeUint64(s.indexBuffer, &size)
 	if s.logFile == nil {
-		if s.logFile, err = os.Open(s.logPath); err != nil {
+		if s.logFile, err = s.fs.Open(s.logPath); err != nil {
 			return err
 		}
 	}
-	if int(size) != mmap.Fsize(s.logFile) {
-		m, err := mmap.Open(mmap.Fd(s.logFile), 0, mmap.Fsize(s.logFile), mmap.READ)
+	logSize, err := fsize(s.logFile)
+	if err != nil {
+		return err
+	}
+	if int(size) < logSize {
+		// The log file written by direct I/O ends with a padding record.
+		header := make([]byte, paddingHeaderSize)
+		if n, _ := s.logFile.ReadAt(header, int64(size)); n == len(header) && int(size)+paddingSize(header) == logSize {
+			logSize = int(size)
+		}
+	}
+	if int(size) != logSize {
+		m, err := mmap.Open(fd(s.logFile), 0, logSize, mmap.READ)
 		if err != nil {
 			return err
 		}
@@ -134,10 +230,14 @@ func (s *segment) load() error {
 		data := m[:]
 		var position, i int
 		for i = 1; len(data) > 0; i++ {
-			var n int
-			var size uint64
-			n = int(code.DecodeVarint(data, &size))
-			n += int(size)
+			if paddingSize(data) > 0 {
+				break
+			}
+			n := recordLength(data)
+			if n == 0 {
+				// The record is partially written by a crash, and openTail cuts it from the active segment.
+				break
+			}
 			data = data[n:]
 			code.EncodeUint64(s.indexBuffer, uint64(position+n))
 			copy(s.indexMmap[i*8:i*8+8], s.indexBuffer)
@@ -150,12 +250,27 @@ func (s *segment) load() error {
 	return nil
 }
 
+// end returns the end offset of the last entry.
+func (s *segment) end() int64 {
+	if s.len == 0 {
+		return 0
+	}
+	_, end := s.readIndex(s.offset + s.len)
+	return int64(end)
+}
+
 func (s *segment) remove() (err error) {
-	os.Remove(s.indexPath)
-	return os.Remove(s.logPath)
+	s.fs.Remove(s.indexPath)
+	return s.fs.Remove(s.logPath)
 }
 
 func (s *segment) close() (err error) {
+	if s.directFile != nil {
+		if err = s.directFile.Close(); err != nil {
+			return err
+		}
+		s.directFile = nil
+	}
 	if s.logFile != nil {
 		if err = s.logFile.Sync(); err != nil {
 			return err
@@ -198,18 +313,69 @@ type Options struct {
 	// NoSplitSegment is used by the Clean method. When this option is set,
 	// do not split the segment. Default is false .
 	NoSplitSegment bool
+	// LogicalClean is used by the Clean method. When this option is set,
+	// the first index is recorded in the manifest, and the entries before it
+	// are kept in the segment until the whole segment is cleaned. Default is false.
+	LogicalClean bool
+	// Compression is the codec to compress entries. Default is nil, no compression.
+	Compression Codec
+	// CompressionThreshold is the minimum size of an entry to be compressed.
+	CompressionThreshold int
+	// Cipher is the cipher to encrypt entries. Default is nil, no encryption.
+	Cipher *Cipher
+	// RecordTime records the write time of each entry, so the index can be
+	// looked up by IndexAt. Default is false.
+	RecordTime bool
+	// CopyBufferSize is the buffer size to copy a segment in Clean and Truncate.
+	CopyBufferSize int
+	// MmapCopy copies a segment in Clean and Truncate by mapping the segment
+	// into memory. Default is false, the segment is copied through a buffer
+	// of CopyBufferSize.
+	MmapCopy bool
+	// DirectIO writes the active segment with O_DIRECT on Linux, bypassing the
+	// page cache. The write buffer is flushed in aligned blocks, and the partial
+	// last block is padded and rewritten by the next flush. It falls back to
+	// buffered I/O when the file system does not support direct I/O. Default is false.
+	DirectIO bool
+	// NoCopy retains the data of an entry instead of copying it to the write
+	// buffer, and writes the data after its header by writev on flush. The data
+	// must not be modified until it is flushed. It applies to the entries of at
+	// least 16 KiB without compression or encryption, and it is ignored with
+	// DirectIO. Default is false.
+	NoCopy bool
+	// SyncMode is the mode to commit the active segment to stable storage.
+	// Default is SyncFsync.
+	SyncMode SyncMode
+	// DirMode is the permission of the directory, masked by the umask.
+	DirMode os.FileMode
+	// FileMode is the permission of the segment, index, temporary, clean
+	// and truncate files, masked by the umask.
+	FileMode os.FileMode
+	// Retention is the number of applied entries retained. When it is greater
+	// than zero, setting the applied index cleans the entries applied before
+	// the retained ones. The entries not applied are never cleaned.
+	Retention int
+
+	// fs is the file system. It is replaced by tests to inject faults.
+	fs fileSystem
+	// budget is the pool and the memory budget of the write buffers shared by the logs of a manager.
+	budget *memoryBudget
 }
 
 // DefaultOptions returns default options.
 func DefaultOptions() *Options {
 	return &Options{
-		SegmentSize:      DefaultSegmentSize,
-		SegmentEntries:   DefaultSegmentEntries,
-		EncodeBufferSize: DefaultEncodeBufferSize,
-		WriteBufferSize:  DefaultWriteBufferSize,
-		LogSuffix:        DefaultLogSuffix,
-		IndexSuffix:      DefaultIndexSuffix,
-		Base:             DefaultBase,
+		SegmentSize:          DefaultSegmentSize,
+		SegmentEntries:       DefaultSegmentEntries,
+		EncodeBufferSize:     DefaultEncodeBufferSize,
+		WriteBufferSize:      DefaultWriteBufferSize,
+		CopyBufferSize:       DefaultCopyBufferSize,
+		LogSuffix:            DefaultLogSuffix,
+		IndexSuffix:          DefaultIndexSuffix,
+		Base:                 DefaultBase,
+		CompressionThreshold: DefaultCompressionThreshold,
+		DirMode:              DefaultDirMode,
+		FileMode:             DefaultFileMode,
 	}
 }
 
@@ -226,12 +392,27 @@ func (opts *Options) check() error {
 	if opts.WriteBufferSize < 1 {
 		opts.WriteBufferSize = DefaultWriteBufferSize
 	}
+	if opts.CopyBufferSize < 1 {
+		opts.CopyBufferSize = DefaultCopyBufferSize
+	}
 	if len(opts.LogSuffix) < 1 {
 		opts.LogSuffix = DefaultLogSuffix
 	}
 	if len(opts.IndexSuffix) < 1 {
 		opts.IndexSuffix = DefaultIndexSuffix
 	}
+	if opts.CompressionThreshold < 1 {
+		opts.CompressionThreshold = DefaultCompressionThreshold
+	}
+	if opts.DirMode == 0 {
+		opts.DirMode = DefaultDirMode
+	}
+	if opts.FileMode == 0 {
+		opts.FileMode = DefaultFileMode
+	}
+	if opts.SyncMode < SyncFsync || opts.SyncMode > SyncDsync {
+		return ErrSyncMode
+	}
 	if opts.Base < 1 {
 		opts.Base = DefaultBase
 	} else if opts.Base < 2 || opts.Base > 36 {
@@ -251,17 +432,48 @@ func Open(path string, opts *Options) (w *WAL, err error) {
 		opts = DefaultOptions()
 	}
 	w = &WAL{
-		path:           path,
-		segmentSize:    opts.SegmentSize,
-		segmentEntries: opts.SegmentEntries,
-		indexSpace:     opts.SegmentEntries*8 + 8,
-		logSuffix:      opts.LogSuffix,
-		indexSuffix:    opts.IndexSuffix,
-		base:           opts.Base,
-		noSplitSegment: opts.NoSplitSegment,
-		nameLength:     len(strconv.FormatUint(1<<64-1, opts.Base)),
-		encodeBuffer:   make([]byte, opts.EncodeBufferSize),
-		writeBuffer:    make([]byte, 0, opts.WriteBufferSize),
+		mu:                   newMutex(),
+		fs:                   opts.fs,
+		path:                 path,
+		segmentSize:          opts.SegmentSize,
+		segmentEntries:       opts.SegmentEntries,
+		indexSpace:           opts.SegmentEntries*8 + 8,
+		logSuffix:            opts.LogSuffix,
+		indexSuffix:          opts.IndexSuffix,
+		base:                 opts.Base,
+		noSplitSegment:       opts.NoSplitSegment,
+		logicalClean:         opts.LogicalClean,
+		mmapCopy:             opts.MmapCopy,
+		copyBufferSize:       opts.CopyBufferSize,
+		directIO:             opts.DirectIO,
+		noCopy:               opts.NoCopy && !opts.DirectIO,
+		syncMode:             opts.SyncMode,
+		nameLength:           len(strconv.FormatUint(1<<64-1, opts.Base)),
+		encodeBuffer:         make([]byte, opts.EncodeBufferSize),
+		writeBuffer:          make([]byte, 0, opts.WriteBufferSize),
+		codec:                opts.Compression,
+		codecs:               map[uint8]Codec{FlateCodecID: NewFlateCodec(flate.DefaultCompression)},
+		compressionThreshold: opts.CompressionThreshold,
+		cipher:               opts.Cipher,
+		recordTime:           opts.RecordTime,
+		budget:               opts.budget,
+	}
+	if w.budget != nil {
+		// The write buffer is taken from the shared pool on demand.
+		w.writeBuffer = nil
+	} else if w.directIO {
+		w.writeBuffer = alignedBuffer(alignUp(opts.WriteBufferSize))[:0]
+	}
+	if opts.Retention > 0 {
+		w.retention = uint64(opts.Retention)
+	}
+	if w.fs == nil {
+		w.fs = osFS{}
+	}
+	w.dirMode, w.fileMode = opts.DirMode.Perm(), opts.FileMode.Perm()
+	w.fs = permFS{fileSystem: w.fs, dirMode: w.dirMode, fileMode: w.fileMode}
+	if w.codec != nil {
+		w.codecs[w.codec.ID()] = w.codec
 	}
 	err = w.load()
 	if err != nil {
@@ -271,17 +483,53 @@ func Open(path string, opts *Options) (w *WAL, err error) {
 }
 
 func (w *WAL) load() (err error) {
-	err = os.MkdirAll(w.path, 0744)
+	err = w.fs.MkdirAll(w.path, w.dirMode)
 	if err != nil {
 		return
 	}
-	tmpName := filepath.Join(w.path, tmpfile)
-	_, err = os.Stat(tmpName)
-	if !os.IsNotExist(err) {
-		os.Remove(tmpName)
+	for _, name := range []string{tmpfile, manifestTmp, appliedTmp} {
+		tmpName := filepath.Join(w.path, name)
+		if _, err = w.fs.Stat(tmpName); !os.IsNotExist(err) {
+			w.fs.Remove(tmpName)
+		}
+	}
+	if err = w.loadAppliedIndex(); err != nil {
+		return err
 	}
+	m, err := readManifest(w.fs, w.path)
+	if err == nil {
+		err = w.loadManifest(m)
+	} else if os.IsNotExist(err) {
+		// The log is written before the manifest is introduced.
+		if err = w.scan(); err == nil {
+			err = w.writeManifest()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if len(w.segments) > 0 {
+		// The first index in the manifest may be after the first entry of
+		// the first segment by a logical clean.
+		if first := w.segments[0].offset + 1; w.firstIndex < first {
+			w.firstIndex = first
+		}
+		if err = w.resetLastSegment(); err != nil {
+			return err
+		}
+		if w.firstIndex > w.lastIndex+1 {
+			w.firstIndex = w.lastIndex + 1
+		}
+		return nil
+	}
+	w.firstIndex = 1
+	return nil
+}
+
+// scan finds the segments by scanning the directory.
+func (w *WAL) scan() (err error) {
 	truncate := false
-	err = filepath.Walk(w.path, func(filePath string, info os.FileInfo, err error) error {
+	return filepath.Walk(w.path, func(filePath string, info os.FileInfo, err error) error {
 		name, n := info.Name(), w.nameLength
 		if len(name) < n+len(w.logSuffix) || info.IsDir() {
 			return nil
@@ -295,10 +543,10 @@ func (w *WAL) load() (err error) {
 		}
 		if len(name) == n+len(w.logSuffix) {
 			if truncate {
-				if err := os.Remove(filePath); err != nil {
+				if err := w.fs.Remove(filePath); err != nil {
 					return err
 				}
-				if err := os.Remove(filepath.Join(w.path, name[:n]+w.indexSuffix)); err != nil {
+				if err := w.fs.Remove(filepath.Join(w.path, name[:n]+w.indexSuffix)); err != nil && !os.IsNotExist(err) {
 					return err
 				}
 				return nil
@@ -309,7 +557,7 @@ func (w *WAL) load() (err error) {
 					w.segments[i].remove()
 				}
 				w.segments = []*segment{}
-				if err := os.Rename(filePath, filepath.Join(w.path, name[:n+len(w.logSuffix)])); err != nil {
+				if err := w.fs.Rename(filePath, filepath.Join(w.path, name[:n+len(w.logSuffix)])); err != nil {
 					return err
 				}
 			} else if len(name) == n+len(w.logSuffix)+len(truncateSuffix) && strings.HasSuffix(name, truncateSuffix) {
@@ -318,7 +566,7 @@ func (w *WAL) load() (err error) {
 					w.segments[len(w.segments)-1].remove()
 					w.segments = w.segments[:len(w.segments)-1]
 				}
-				if err := os.Rename(filePath, filepath.Join(w.path, name[:n+len(w.logSuffix)])); err != nil {
+				if err := w.fs.Rename(filePath, filepath.Join(w.path, name[:n+len(w.logSuffix)])); err != nil {
 					return err
 				}
 			}
@@ -328,22 +576,204 @@ func (w *WAL) load() (err error) {
 			offset:      offset,
 			logPath:     filepath.Join(w.path, name),
 			indexPath:   filepath.Join(w.path, name[:n]+w.indexSuffix),
+			fs:          w.fs,
 			indexBuffer: make([]byte, 8),
 			indexSpace:  w.indexSpace,
 		})
 		return nil
 	})
+}
+
+// loadManifest loads the segments from the manifest, and completes the
+// pending operation if any.
+func (w *WAL) loadManifest(m *manifest) (err error) {
+	w.firstIndex = m.firstIndex
+	for _, s := range m.segments {
+		w.segments = append(w.segments, &segment{
+			offset:      s.offset,
+			logPath:     filepath.Join(w.path, s.name),
+			indexPath:   filepath.Join(w.path, w.indexName(s.offset)),
+			fs:          w.fs,
+			indexBuffer: make([]byte, 8),
+			indexSpace:  w.indexSpace,
+		})
+	}
+	dirty := false
+	switch m.pending {
+	case 0:
+	case pendingClean:
+		err = w.completeClean(m.pendingOffset)
+		dirty = true
+	case pendingTruncate:
+		err = w.completeTruncate(m.pendingOffset)
+		dirty = true
+	case pendingReset:
+		err = w.completeReset(m.pendingOffset)
+		dirty = true
+	default:
+		return ErrBadManifest
+	}
 	if err != nil {
 		return err
 	}
-	if len(w.segments) > 0 {
-		w.firstIndex = w.segments[0].offset + 1
-		return w.resetLastSegment()
+	// The segments are removed before the manifest is written, so the missing
+	// segments can be only at the head or at the tail.
+	for len(w.segments) > 0 {
+		if exist, err := w.exist(w.segments[0].logPath); err != nil {
+			return err
+		} else if exist {
+			break
+		}
+		w.segments = w.segments[1:]
+		dirty = true
 	}
-	w.firstIndex = 1
+	for len(w.segments) > 0 {
+		if exist, err := w.exist(w.segments[len(w.segments)-1].logPath); err != nil {
+			return err
+		} else if exist {
+			break
+		}
+		w.segments = w.segments[:len(w.segments)-1]
+		dirty = true
+	}
+	if dirty {
+		return w.writeManifest()
+	}
+	return nil
+}
+
+// completeClean removes the segments before the offset, and renames the
+// clean file if it has not been renamed.
+func (w *WAL) completeClean(offset uint64) (err error) {
+	cleanName := filepath.Join(w.path, w.logName(offset)+cleanSuffix)
+	exist, err := w.exist(cleanName)
+	if err != nil {
+		return err
+	}
+	renamed := !exist
+	var i int
+	for i = 0; i < len(w.segments) && (w.segments[i].offset < offset || !renamed && w.segments[i].offset == offset); i++ {
+		if err = w.removeSegment(w.segments[i]); err != nil {
+			return err
+		}
+	}
+	w.segments = w.segments[i:]
+	if !renamed {
+		if err = w.fs.Rename(cleanName, filepath.Join(w.path, w.logName(offset))); err != nil {
+			return err
+		}
+	}
+	if len(w.segments) == 0 || w.segments[0].offset != offset {
+		w.segments = append([]*segment{w.newSegment(offset)}, w.segments...)
+	}
+	return nil
+}
+
+// completeTruncate removes the segments after the offset, and renames the
+// truncate file if it has not been renamed.
+func (w *WAL) completeTruncate(offset uint64) (err error) {
+	truncateName := filepath.Join(w.path, w.logName(offset)+truncateSuffix)
+	exist, err := w.exist(truncateName)
+	if err != nil {
+		return err
+	}
+	renamed := !exist
+	i := len(w.segments)
+	for ; i > 0 && (w.segments[i-1].offset > offset || !renamed && w.segments[i-1].offset == offset); i-- {
+		if err = w.removeSegment(w.segments[i-1]); err != nil {
+			return err
+		}
+	}
+	w.segments = w.segments[:i]
+	if !renamed {
+		if err = w.fs.Rename(truncateName, filepath.Join(w.path, w.logName(offset))); err != nil {
+			return err
+		}
+		w.segments = append(w.segments, w.newSegment(offset))
+	}
+	return nil
+}
+
+// completeReset removes the segments, and renames the clean file of the
+// empty segment at the offset if it has not been renamed.
+func (w *WAL) completeReset(offset uint64) (err error) {
+	cleanName := filepath.Join(w.path, w.logName(offset)+cleanSuffix)
+	exist, err := w.exist(cleanName)
+	if err != nil {
+		return err
+	}
+	renamed := !exist
+	for _, s := range w.segments {
+		if renamed && s.offset == offset {
+			continue
+		}
+		if err = w.removeSegment(s); err != nil {
+			return err
+		}
+	}
+	if !renamed {
+		if err = w.fs.Rename(cleanName, filepath.Join(w.path, w.logName(offset))); err != nil {
+			return err
+		}
+	}
+	w.segments = []*segment{w.newSegment(offset)}
+	w.firstIndex = offset + 1
 	return nil
 }
 
+func (w *WAL) newSegment(offset uint64) *segment {
+	return &segment{
+		offset:      offset,
+		logPath:     filepath.Join(w.path, w.logName(offset)),
+		indexPath:   filepath.Join(w.path, w.indexName(offset)),
+		fs:          w.fs,
+		indexBuffer: make([]byte, 8),
+		indexSpace:  w.indexSpace,
+	}
+}
+
+// removeSegment removes the files of the segment that may not exist.
+func (w *WAL) removeSegment(s *segment) error {
+	if err := w.fs.Remove(s.indexPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := w.fs.Remove(s.logPath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func (w *WAL) exist(name string) (bool, error) {
+	if _, err := w.fs.Stat(name); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// manifest returns the manifest of the segments.
+func (w *WAL) manifest() *manifest {
+	m := &manifest{firstIndex: w.firstIndex, lastIndex: w.lastIndex}
+	for _, s := range w.segments {
+		m.segments = append(m.segments, manifestSegment{name: filepath.Base(s.logPath), offset: s.offset})
+	}
+	return m
+}
+
+// writeManifest writes the manifest of the segments.
+func (w *WAL) writeManifest() error {
+	return writeManifest(w.fs, w.path, w.manifest())
+}
+
+// writePending writes the manifest with the pending operation.
+func (w *WAL) writePending(pending, offset uint64) error {
+	m := w.manifest()
+	m.pending, m.pendingOffset = pending, offset
+	return writeManifest(w.fs, w.path, m)
+}
+
 func (w *WAL) appendSegment() (err error) {
 	if err = w.closeLastSegment(); err != nil {
 		return err
@@ -352,15 +782,16 @@ func (w *WAL) appendSegment() (err error) {
 		offset:      w.lastIndex,
 		logPath:     filepath.Join(w.path, w.logName(w.lastIndex)),
 		indexPath:   filepath.Join(w.path, w.indexName(w.lastIndex)),
+		fs:          w.fs,
 		indexBuffer: make([]byte, 8),
 		indexSpace:  w.indexSpace,
 	}
 	w.segments = append(w.segments, s)
 	w.lastSegment = s
-	if s.logFile, err = os.Create(s.logPath); err != nil {
+	if s.logFile, err = w.fs.OpenFile(s.logPath, os.O_RDWR|os.O_CREATE|os.O_TRUNC|w.logFlag(), w.fileMode); err != nil {
 		return err
 	}
-	if s.indexFile, err = os.Create(s.indexPath); err != nil {
+	if s.indexFile, err = s.fs.Create(s.indexPath); err != nil {
 		return err
 	}
 	if err = s.indexFile.Truncate(int64(w.indexSpace)); err != nil {
@@ -369,10 +800,13 @@ func (w *WAL) appendSegment() (err error) {
 	if err = s.indexFile.Sync(); err != nil {
 		return err
 	}
-	if s.indexMmap, err = mmap.Open(mmap.Fd(s.indexFile), 0, mmap.Fsize(s.indexFile), mmap.READ|mmap.WRITE); err != nil {
+	if s.indexMmap, err = mmap.Open(fd(s.indexFile), 0, w.indexSpace, mmap.READ|mmap.WRITE); err != nil {
 		return err
 	}
-	return
+	if err = w.openTail(s); err != nil {
+		return err
+	}
+	return w.writeManifest()
 }
 
 func (w *WAL) resetLastSegment() (err error) {
@@ -380,21 +814,21 @@ func (w *WAL) resetLastSegment() (err error) {
 		return err
 	}
 	lastSegment := w.segments[len(w.segments)-1]
+	lastSegment.times = nil
 	w.lastSegment = lastSegment
-	if lastSegment.logFile, err = os.OpenFile(lastSegment.logPath, os.O_RDWR, 0666); err != nil {
+	if lastSegment.logFile, err = w.fs.OpenFile(lastSegment.logPath, os.O_RDWR|w.logFlag(), w.fileMode); err != nil {
 		return err
 	}
-	if n, err := lastSegment.logFile.Seek(0, os.SEEK_END); err != nil {
-		return err
-	} else if n <= 0 {
-		w.lastIndex = lastSegment.offset
-		return nil
-	}
 	if err := lastSegment.load(); err != nil {
 		return err
 	}
 	w.lastIndex = lastSegment.offset + uint64(lastSegment.len)
-	return nil
+	if w.recordTime && w.lastTime == 0 {
+		if err = w.loadLastTime(); err != nil {
+			return err
+		}
+	}
+	return w.openTail(lastSegment)
 }
 
 func (w *WAL) closeLastSegment() (err error) {
@@ -413,9 +847,67 @@ func (w *WAL) loadSegment(s *segment) (err error) {
 
 // Reset discards all entries.
 func (w *WAL) Reset() (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrClosed
+	}
+	return w.reset()
+}
+
+// ResetTo discards all entries and sets the index of the next entry to nextIndex.
+// The next index is persisted by an empty segment, so it survives a restart
+// even before any entry is written.
+func (w *WAL) ResetTo(nextIndex uint64) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	if w.closed {
 		return ErrClosed
 	}
+	if nextIndex == 0 {
+		return ErrZeroIndex
+	}
+	w.generation++
+	offset := nextIndex - 1
+	// The empty segment is created as a clean file first, so the load
+	// removes the old segments if a crash happens before the rename.
+	cleanName := filepath.Join(w.path, w.logName(offset)+cleanSuffix)
+	if err = w.createEmpty(cleanName); err != nil {
+		return err
+	}
+	if err = w.writePending(pendingReset, offset); err != nil {
+		return err
+	}
+	if err = w.close(); err != nil {
+		return err
+	}
+	for i := 0; i < len(w.segments); i++ {
+		w.segments[i].remove()
+	}
+	name := filepath.Join(w.path, w.logName(offset))
+	if err = w.fs.Rename(cleanName, name); err != nil {
+		return err
+	}
+	w.resetWriteBuffer()
+	w.discardFutures(0)
+	w.lastSegment = nil
+	w.segments = append(w.segments[:0], &segment{
+		fs:          w.fs,
+		offset:      offset,
+		logPath:     name,
+		indexPath:   filepath.Join(w.path, w.indexName(offset)),
+		indexBuffer: make([]byte, 8),
+		indexSpace:  w.indexSpace,
+	})
+	w.firstIndex = nextIndex
+	if err = w.resetLastSegment(); err != nil {
+		return err
+	}
+	return w.writeManifest()
+}
+
+func (w *WAL) reset() (err error) {
+	w.generation++
 	if err = w.close(); err != nil {
 		return err
 	}
@@ -434,7 +926,7 @@ func (w *WAL) Reset() (err error) {
 		if name[n:n+len(w.logSuffix)] != w.logSuffix && name[n:n+len(w.indexSuffix)] != w.indexSuffix {
 			return nil
 		}
-		if err := os.Remove(filePath); err != nil {
+		if err := w.fs.Remove(filePath); err != nil {
 			return err
 		}
 		return nil
@@ -444,44 +936,100 @@ func (w *WAL) Reset() (err error) {
 		w.lastIndex = 0
 		w.lastSegment = nil
 		w.segments = w.segments[:0]
+		w.resetWriteBuffer()
+		w.discardFutures(0)
+		err = w.writeManifest()
 	}
 	return err
 }
 
 // Write writes an entry to buffer.
 func (w *WAL) Write(index uint64, data []byte) (err error) {
+	w.mu.Lock()
+	err = w.write(index, data, nil)
+	w.mu.Unlock()
+	return
+}
+
+// Append writes an entry to buffer at the next index and returns the index.
+func (w *WAL) Append(data []byte) (index uint64, err error) {
+	w.mu.Lock()
+	index = w.lastIndex + 1
+	err = w.write(index, data, nil)
+	w.mu.Unlock()
+	return
+}
+
+// AppendBatch writes the entries to buffer at the next indexes and returns
+// the first and the last index. On error the entries before last are written.
+func (w *WAL) AppendBatch(entries [][]byte) (first, last uint64, err error) {
+	w.mu.Lock()
+	first = w.lastIndex + 1
+	last = w.lastIndex
+	for _, data := range entries {
+		if err = w.write(last+1, data, nil); err != nil {
+			break
+		}
+		last++
+	}
+	w.mu.Unlock()
+	return
+}
+
+func (w *WAL) write(index uint64, data []byte, m *meta) (err error) {
+	offset, err := w.prepareWrite(index)
+	if err != nil {
+		return err
+	}
+	var entryData, retained []byte
+	if w.noCopy && m == nil && len(data) >= noCopyThreshold && w.codec == nil && w.cipher == nil {
+		// The data is retained, and written after its header by writev on flush.
+		entryData, retained = w.encodeHeader(len(data)), data
+	} else if entryData, err = w.encode(index, data, m); err != nil {
+		return err
+	}
+	return w.appendRecord(index, offset, entryData, retained)
+}
+
+// prepareWrite checks the index of the entry to write, and returns the offset
+// of the end of the active segment.
+func (w *WAL) prepareWrite(index uint64) (offset int, err error) {
 	if w.closed {
-		return ErrClosed
+		return 0, ErrClosed
 	}
 	if index == 0 {
-		return ErrZeroIndex
+		return 0, ErrZeroIndex
 	}
-	if w.lastIndex > 0 && index != w.lastIndex+1 {
-		return ErrOutOfOrder
-	} else if w.lastIndex == 0 {
+	if len(w.segments) > 0 && index != w.lastIndex+1 {
+		return 0, ErrOutOfOrder
+	} else if len(w.segments) == 0 {
 		w.firstIndex = index
 		w.lastIndex = index - 1
 	}
 	if len(w.segments) == 0 {
 		if err = w.appendSegment(); err != nil {
-			return err
+			return 0, err
 		}
 	}
+	if w.directIO {
+		return int(w.directOffset), nil
+	}
 	end, err := w.lastSegment.logFile.Seek(0, os.SEEK_END)
 	if err != nil {
-		return err
-	}
-	offset := int(end)
-	size := 10 + len(data)
-	if cap(w.encodeBuffer) >= size {
-		w.encodeBuffer = w.encodeBuffer[:size]
-	} else {
-		w.encodeBuffer = make([]byte, size)
+		return 0, err
 	}
-	n := code.EncodeVarint(w.encodeBuffer, uint64(len(data)))
-	copy(w.encodeBuffer[n:], data)
-	entryData := w.encodeBuffer[:int(n)+len(data)]
-	if offset+len(w.writeBuffer)+len(entryData) > w.segmentSize || int(index-w.lastSegment.offset) > w.segmentEntries {
+	return int(end), nil
+}
+
+// appendRecord appends the record of the entry at index to the write buffer,
+// and appends a new segment first if the active segment is full. The retained
+// data follows the record by writev on flush.
+func (w *WAL) appendRecord(index uint64, offset int, entryData, retained []byte) (err error) {
+	size := len(entryData) + len(retained)
+	if size > w.segmentSize {
+		return ErrEntryTooLarge
+	}
+	if offset+w.buffered()+size > w.segmentSize || int(index-w.lastSegment.offset) > w.segmentEntries {
 		if err := w.flush(); err != nil {
 			return err
 		}
@@ -494,39 +1042,93 @@ func (w *WAL) Write(index uint64, data []byte) (err error) {
 		w.lastSegment = w.segments[len(w.segments)-1]
 		offset = 0
 	}
+	if w.directIO {
+		w.reserve(len(entryData))
+	}
 	entries := index - w.lastSegment.offset
 	code.EncodeUint64(w.lastSegment.indexBuffer, uint64(entries))
 	copy(w.lastSegment.indexMmap, w.lastSegment.indexBuffer)
-	code.EncodeUint64(w.lastSegment.indexBuffer, uint64(offset+len(w.writeBuffer)+len(entryData)))
+	code.EncodeUint64(w.lastSegment.indexBuffer, uint64(offset+w.buffered()+size))
 	copy(w.lastSegment.indexMmap[entries*8:entries*8+8], w.lastSegment.indexBuffer)
 	w.lastSegment.len = entries
+	if w.writeBuffer == nil && w.budget != nil && !w.directIO {
+		w.writeBuffer = w.budget.get()
+	}
 	w.writeBuffer = append(w.writeBuffer, entryData...)
+	if retained != nil {
+		w.vectors = append(w.vectors, vector{end: len(w.writeBuffer), data: retained})
+		w.retainedSize += len(retained)
+	}
 	w.lastIndex = index
+	if w.budget != nil && w.budget.acquire(size) {
+		return w.flush()
+	}
 	return nil
 }
 
 // Flush writes buffered data to file.
 func (w *WAL) Flush() error {
-	return w.flush()
+	w.mu.Lock()
+	err := w.flush()
+	w.mu.Unlock()
+	return err
 }
 
 func (w *WAL) flush() (err error) {
 	if w.closed {
 		return ErrClosed
 	}
-	if len(w.writeBuffer) > 0 {
+	if w.directIO {
+		if len(w.writeBuffer) > w.tail {
+			if err = w.flushDirect(); err == nil {
+				w.unsynced = true
+			}
+		}
+		return
+	}
+	if len(w.vectors) > 0 {
+		if err = writev(w.lastSegment.logFile, w.buffers()); err == nil {
+			w.resetWriteBuffer()
+			w.unsynced = true
+		}
+	} else if len(w.writeBuffer) > 0 {
 		if _, err = w.lastSegment.logFile.Write(w.writeBuffer); err == nil {
-			w.writeBuffer = w.writeBuffer[:0]
+			w.resetWriteBuffer()
+			w.unsynced = true
 		}
 	}
 	return
 }
 
+// resetWriteBuffer discards the buffered data and releases its memory budget.
+// A write buffer of a manager is returned to the shared pool.
+func (w *WAL) resetWriteBuffer() {
+	if w.budget != nil {
+		w.budget.release(len(w.writeBuffer) + w.retainedSize - w.tail)
+		if !w.directIO {
+			w.budget.put(w.writeBuffer)
+			w.writeBuffer = nil
+		}
+	}
+	w.writeBuffer = w.writeBuffer[:0]
+	w.tail = 0
+	if len(w.vectors) > 0 {
+		for i := range w.vectors {
+			w.vectors[i].data = nil
+		}
+		w.vectors = w.vectors[:0]
+		w.retainedSize = 0
+	}
+}
+
 // Sync commits the current contents of the file to stable storage.
 // Typically, this means flushing the file system's in-memory copy
 // of recently written data to disk.
 func (w *WAL) Sync() error {
-	return w.sync()
+	w.mu.Lock()
+	err := w.sync()
+	w.mu.Unlock()
+	return err
 }
 
 func (w *WAL) sync() (err error) {
@@ -534,17 +1136,22 @@ func (w *WAL) sync() (err error) {
 		return ErrClosed
 	}
 	if w.lastSegment != nil {
-		err = w.lastSegment.logFile.Sync()
+		if err = w.syncFile(w.lastSegment.logFile); err == nil {
+			w.unsynced = false
+		}
 	}
 	return
 }
 
 // Close closes the write-ahead log.
 func (w *WAL) Close() (err error) {
-	if err = w.flush(); err != nil {
-		return err
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if err = w.flush(); err == nil {
+		err = w.sync()
 	}
-	if err = w.sync(); err != nil {
+	w.stopCommit(err)
+	if err != nil {
 		return err
 	}
 	if w.closed {
@@ -565,14 +1172,30 @@ func (w *WAL) close() (err error) {
 
 // FirstIndex returns the write-ahead log first index.
 func (w *WAL) FirstIndex() (index uint64, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	if w.closed {
 		return 0, ErrClosed
 	}
 	return w.firstIndex, nil
 }
 
+// Generation returns the truncation generation of the log. It starts at zero
+// when the log is opened, and is incremented whenever the entries at the tail
+// are discarded by Truncate, Reset or ResetTo.
+func (w *WAL) Generation() (generation uint64, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return 0, ErrClosed
+	}
+	return w.generation, nil
+}
+
 // LastIndex returns the write-ahead log last index.
 func (w *WAL) LastIndex() (index uint64, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	if w.closed {
 		return 0, ErrClosed
 	}
@@ -595,6 +1218,8 @@ func (w *WAL) searchSegmentIndex(index uint64) int {
 
 // IsExist returns true when the index is in range.
 func (w *WAL) IsExist(index uint64) (bool, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	if err := w.checkIndex(index); err != nil {
 		if err == ErrClosed {
 			return false, err
@@ -616,6 +1241,29 @@ func (w *WAL) checkIndex(index uint64) error {
 
 // Read returns an entry by index.
 func (w *WAL) Read(index uint64) (data []byte, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.read(index, nil)
+}
+
+func (w *WAL) read(index uint64, m *meta) (data []byte, err error) {
+	entryData, err := w.readRecord(index)
+	if err != nil {
+		return nil, err
+	}
+	return w.decode(index, entryData, m)
+}
+
+// ReadRecord returns the record of the entry at index as it is stored, with the
+// fields of the entry and the compressed or encrypted entry data. A record is
+// copied to another log by WriteRecord, which keeps the log byte for byte.
+func (w *WAL) ReadRecord(index uint64) (record []byte, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.readRecord(index)
+}
+
+func (w *WAL) readRecord(index uint64) (entryData []byte, err error) {
 	if err := w.checkIndex(index); err != nil {
 		return nil, err
 	}
@@ -624,37 +1272,71 @@ func (w *WAL) Read(index uint64) (data []byte, err error) {
 	if err = w.loadSegment(s); err != nil {
 		return nil, err
 	}
-	var start, end = s.readIndex(index)
-	ret, _ := s.logFile.Seek(int64(start), os.SEEK_SET)
-	entryData := make([]byte, end-start)
-	n, err := s.logFile.ReadAt(entryData, ret)
+	if w.directIO && s == w.lastSegment {
+		// The file has the padding instead of the buffered entries.
+		if _, end := s.readIndex(index); int64(end) > w.directOffset+int64(w.tail) {
+			return nil, io.EOF
+		}
+	}
+	return s.readRecord(index)
+}
+
+// WriteRecord writes a record read by ReadRecord to buffer at index unchanged.
+// The index must be the next index like Write. An encrypted record can be read
+// only with the cipher of the log it was read from.
+func (w *WAL) WriteRecord(index uint64, record []byte) (err error) {
+	var m meta
+	if _, _, _, err = decodeFields(record, &m); err != nil {
+		return err
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	offset, err := w.prepareWrite(index)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	if len(entryData) != n {
-		return nil, ErrUnexpectedSize
+	if err = w.appendRecord(index, offset, record, nil); err != nil {
+		return err
 	}
-	var size uint64
-	n = int(code.DecodeVarint(entryData, &size))
-	if uint64(len(entryData)-n) != size {
-		return nil, ErrUnexpectedSize
+	if m.time > w.lastTime {
+		// The write times stay monotonic in the log.
+		w.lastTime = m.time
 	}
-	return entryData[n:], nil
+	return nil
 }
 
 // Clean cleans up the old entries before index.
 func (w *WAL) Clean(index uint64) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.clean(context.Background(), index)
+}
+
+func (w *WAL) clean(ctx context.Context, index uint64) (err error) {
 	if index == w.firstIndex {
 		return nil
 	}
 	if err := w.checkIndex(index); err != nil {
 		return err
 	}
+	if err = w.flush(); err != nil {
+		return err
+	}
 	segIndex := w.searchSegmentIndex(index)
 	s := w.segments[segIndex]
 	if err = w.loadSegment(s); err != nil {
 		return err
 	}
+	if w.logicalClean {
+		removes := w.segments[:segIndex]
+		w.segments = w.segments[segIndex:]
+		w.firstIndex = index
+		for i := 0; i < len(removes); i++ {
+			removes[i].close()
+			removes[i].remove()
+		}
+		return w.writeManifest()
+	}
 	if w.noSplitSegment || s.offset == index-1 {
 		if segIndex > 0 {
 			removes := w.segments[:segIndex]
@@ -664,6 +1346,7 @@ func (w *WAL) Clean(index uint64) (err error) {
 				removes[i].close()
 				removes[i].remove()
 			}
+			return w.writeManifest()
 		}
 		return
 	}
@@ -672,7 +1355,10 @@ func (w *WAL) Clean(index uint64) (err error) {
 	_, end := s.readIndex(s.offset + s.len)
 	offset := int(start)
 	size := int(end - start)
-	if err = w.copy(s.logPath, cleanName, offset, size); err != nil {
+	if err = w.copy(ctx, s.logPath, cleanName, offset, size); err != nil {
+		return err
+	}
+	if err = w.writePending(pendingClean, index-1); err != nil {
 		return err
 	}
 	for i := 0; i <= segIndex; i++ {
@@ -680,89 +1366,164 @@ func (w *WAL) Clean(index uint64) (err error) {
 		w.segments[i].remove()
 	}
 	name := filepath.Join(w.path, w.logName(index-1))
-	if err = os.Rename(cleanName, name); err != nil {
+	if err = w.fs.Rename(cleanName, name); err != nil {
 		return err
 	}
 	s.logPath = name
 	s.indexPath = filepath.Join(w.path, w.indexName(index-1))
 	s.offset = index - 1
 	s.len = 0
+	s.times = nil
 	w.segments = w.segments[segIndex:]
 	w.firstIndex = index
 	if len(w.segments) == 1 {
-		return w.resetLastSegment()
+		if err = w.resetLastSegment(); err != nil {
+			return err
+		}
 	}
-	return nil
+	return w.writeManifest()
 }
 
 // Truncate deletes the dirty entries after index.
 func (w *WAL) Truncate(index uint64) (err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.truncate(context.Background(), index)
+}
+
+func (w *WAL) truncate(ctx context.Context, index uint64) (err error) {
 	if index == w.lastIndex {
 		return nil
 	}
 	if err := w.checkIndex(index); err != nil {
 		return err
 	}
+	w.generation++
+	if err = w.flush(); err != nil {
+		return err
+	}
 	segIndex := w.searchSegmentIndex(index)
 	s := w.segments[segIndex]
 	if err = w.loadSegment(s); err != nil {
 		return err
 	}
-	if len(w.segments) > segIndex+1 {
-		next := w.segments[segIndex+1]
-		if err = w.loadSegment(next); err != nil {
-			return err
-		}
-		if next.offset == index {
-			for i := segIndex + 1; i < len(w.segments); i++ {
-				w.segments[i].close()
-				w.segments[i].remove()
-			}
-			w.segments = w.segments[:segIndex+1]
-			w.lastIndex = index
-			return
-		}
-	}
+	// The kept entries are copied even when index is the last entry of the
+	// segment, because a sealed segment may be hard linked by a checkpoint
+	// and must not be reopened for writing.
 	truncateName := filepath.Join(w.path, w.logName(s.offset)+truncateSuffix)
 	start, _ := s.readIndex(s.offset + 1)
 	_, end := s.readIndex(index)
 	offset := int(start)
 	size := int(end - start)
-	if err = w.copy(s.logPath, truncateName, offset, size); err != nil {
+	if err = w.copy(ctx, s.logPath, truncateName, offset, size); err != nil {
 		return err
 	}
-	for i := segIndex; i < len(w.segments); i++ {
+	if err = w.writePending(pendingTruncate, s.offset); err != nil {
+		return err
+	}
+	for i := len(w.segments) - 1; i >= segIndex; i-- {
 		w.segments[i].close()
 		w.segments[i].remove()
 	}
 	filePath := filepath.Join(w.path, w.logName(s.offset))
-	if err = os.Rename(truncateName, filePath); err != nil {
+	if err = w.fs.Rename(truncateName, filePath); err != nil {
 		return err
 	}
 	s.logPath = filePath
 	w.segments = w.segments[:segIndex+1]
 	w.lastIndex = index
-	return w.resetLastSegment()
+	w.discardFutures(index)
+	if err = w.resetLastSegment(); err != nil {
+		return err
+	}
+	return w.writeManifest()
+}
+
+// copy copies size bytes at offset of the source file to the destination file
+// through the temporary file. It stops before the rename when the context is done.
+func (w *WAL) copy(ctx context.Context, srcName string, dstName string, offset, size int) (err error) {
+	tmpName := filepath.Join(w.path, tmpfile)
+	if w.mmapCopy {
+		err = w.copyMmap(srcName, tmpName, offset, size)
+	} else {
+		err = w.copyStream(ctx, srcName, tmpName, offset, size)
+	}
+	if err == nil {
+		err = checkContext(ctx)
+	}
+	if err != nil {
+		if err == ErrCanceled {
+			w.fs.Remove(tmpName)
+		}
+		return err
+	}
+	return w.fs.Rename(tmpName, dstName)
 }
 
-func (w *WAL) copy(srcName string, dstName string, offset, size int) (err error) {
-	var srcFile, tmpFile *os.File
-	if srcFile, err = os.Open(srcName); err != nil {
+// copyStream copies the source file to the temporary file through a buffer
+// of the copy buffer size, and checks the context between the chunks.
+func (w *WAL) copyStream(ctx context.Context, srcName string, tmpName string, offset, size int) (err error) {
+	var srcFile, tmpFile file
+	if srcFile, err = w.fs.Open(srcName); err != nil {
+		return err
+	}
+	defer srcFile.Close()
+	if tmpFile, err = w.fs.Create(tmpName); err != nil {
+		return err
+	}
+	bufferSize := w.copyBufferSize
+	if bufferSize > size {
+		bufferSize = size
+	}
+	buf := make([]byte, bufferSize)
+	for copied := 0; copied < size; {
+		if err = checkContext(ctx); err != nil {
+			tmpFile.Close()
+			return err
+		}
+		n := size - copied
+		if n > len(buf) {
+			n = len(buf)
+		}
+		if _, err = srcFile.ReadAt(buf[:n], int64(offset+copied)); err != nil {
+			tmpFile.Close()
+			return err
+		}
+		if _, err = tmpFile.Write(buf[:n]); err != nil {
+			tmpFile.Close()
+			return err
+		}
+		copied += n
+	}
+	if err = tmpFile.Sync(); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	return tmpFile.Close()
+}
+
+// copyMmap copies the source file to the temporary file by mapping both files into memory.
+func (w *WAL) copyMmap(srcName string, tmpName string, offset, size int) (err error) {
+	var srcFile, tmpFile file
+	if srcFile, err = w.fs.Open(srcName); err != nil {
+		return err
+	}
+	var srcSize int
+	if srcSize, err = fsize(srcFile); err != nil {
 		return err
 	}
 	var m []byte
-	if m, err = mmap.Open(mmap.Fd(srcFile), 0, mmap.Fsize(srcFile), mmap.READ); err != nil {
+	if m, err = mmap.Open(fd(srcFile), 0, srcSize, mmap.READ); err != nil {
 		return err
 	}
-	tmpName := filepath.Join(w.path, tmpfile)
-	if tmpFile, err = os.Create(tmpName); err != nil {
+	if tmpFile, err = w.fs.Create(tmpName); err != nil {
 		return err
 	}
 	if err = tmpFile.Truncate(int64(size)); err != nil {
 		return err
 	}
 	var tmpMmap []byte
-	if tmpMmap, err = mmap.Open(mmap.Fd(tmpFile), 0, mmap.Fsize(tmpFile), mmap.WRITE); err != nil {
+	if tmpMmap, err = mmap.Open(fd(tmpFile), 0, size, mmap.WRITE); err != nil {
 		return err
 	}
 	copy(tmpMmap, m[offset:offset+size])
@@ -781,13 +1542,23 @@ func (w *WAL) copy(srcName string, dstName string, offset, size int) (err error)
 	if err = mmap.Munmap(m); err != nil {
 		return err
 	}
-	if err = srcFile.Close(); err != nil {
+	return srcFile.Close()
+}
+
+func (w *WAL) createEmpty(name string) (err error) {
+	var tmpFile file
+	tmpName := filepath.Join(w.path, tmpfile)
+	if tmpFile, err = w.fs.Create(tmpName); err != nil {
 		return err
 	}
-	if err = os.Rename(tmpName, dstName); err != nil {
+	if err = tmpFile.Sync(); err != nil {
+		tmpFile.Close()
 		return err
 	}
-	return nil
+	if err = tmpFile.Close(); err != nil {
+		return err
+	}
+	return w.fs.Rename(tmpName, name)
 }
 
 func (w *WAL) logName(offset uint64) string {
@@ -4,9 +4,15 @@
 package wal
 
 import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestWal(t *testing.T) {
@@ -104,6 +110,120 @@ func TestWal(t *testing.T) {
 	os.RemoveAll(file)
 }
 
+func TestAppend(t *testing.T) {
+	file := "wal"
+	os.RemoveAll(file)
+	w, err := Open(file, &Options{SegmentEntries: 3})
+	if err != nil {
+		t.Error(err)
+	}
+	if index, err := w.Append([]byte{1}); err != nil {
+		t.Error(err)
+	} else if index != 1 {
+		t.Error(index)
+	}
+	if first, last, err := w.AppendBatch([][]byte{{2}, {3}, {4}}); err != nil {
+		t.Error(err)
+	} else if first != 2 || last != 4 {
+		t.Error(first, last)
+	}
+	if first, last, err := w.AppendBatch(nil); err != nil {
+		t.Error(err)
+	} else if first != 5 || last != 4 {
+		t.Error(first, last)
+	}
+	if err = w.Write(5, []byte{5}); err != nil {
+		t.Error(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 16; j++ {
+				index, err := w.Append([]byte{byte(j)})
+				if err != nil {
+					t.Error(err)
+				}
+				w.Flush()
+				if data, err := w.Read(index); err != nil {
+					t.Error(err)
+				} else if data[0] != byte(j) {
+					t.Error(data)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if index, err := w.LastIndex(); err != nil {
+		t.Error(err)
+	} else if index != 5+8*16 {
+		t.Error(index)
+	}
+	w.Close()
+	if _, err = w.Append([]byte{0}); err != ErrClosed {
+		t.Error(err)
+	}
+	if _, _, err = w.AppendBatch([][]byte{{0}}); err != ErrClosed {
+		t.Error(err)
+	}
+	os.RemoveAll(file)
+}
+
+func TestResetTo(t *testing.T) {
+	file := "wal"
+	os.RemoveAll(file)
+	w, err := Open(file, &Options{SegmentEntries: 3})
+	if err != nil {
+		t.Error(err)
+	}
+	for i := uint64(1); i <= 5; i++ {
+		w.Write(i, []byte{byte(i)})
+	}
+	w.Flush()
+	for _, next := range []uint64{100, 50, 50, 1} {
+		if err = w.ResetTo(next); err != nil {
+			t.Error(err)
+		}
+		w.Close()
+		w, err = Open(file, &Options{SegmentEntries: 3})
+		if err != nil {
+			t.Error(err)
+		}
+		if index, _ := w.FirstIndex(); index != next {
+			t.Error(index)
+		}
+		if index, _ := w.LastIndex(); index != next-1 {
+			t.Error(index)
+		}
+		if ok, _ := w.IsExist(next - 1); ok {
+			t.Error()
+		}
+		if err = w.Write(next+1, []byte{0}); err != ErrOutOfOrder {
+			t.Error(err)
+		}
+		for i := next; i < next+5; i++ {
+			if err = w.Write(i, []byte{byte(i)}); err != nil {
+				t.Error(err)
+			}
+		}
+		w.Flush()
+		if data, err := w.Read(next + 4); err != nil {
+			t.Error(err)
+		} else if data[0] != byte(next+4) {
+			t.Error(data)
+		}
+	}
+	if err = w.ResetTo(0); err != ErrZeroIndex {
+		t.Error(err)
+	}
+	w.Close()
+	if err = w.ResetTo(1); err != ErrClosed {
+		t.Error(err)
+	}
+	os.RemoveAll(file)
+}
+
 func TestOptions(t *testing.T) {
 	var opts = &Options{}
 	opts.check()
@@ -116,6 +236,148 @@ func TestOptions(t *testing.T) {
 	if err := opts.check(); err != ErrBase {
 		t.Error(opts.Base)
 	}
+	opts = DefaultOptions()
+	opts.SyncMode = SyncDsync + 1
+	if err := opts.check(); err != ErrSyncMode {
+		t.Error(opts.SyncMode)
+	}
+}
+
+func TestNoCopy(t *testing.T) {
+	file := "wal"
+	os.RemoveAll(file)
+	opts := &Options{SegmentEntries: 8, NoCopy: true}
+	w, err := Open(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	entry := func(i uint64) []byte {
+		return bytes.Repeat([]byte{byte(i)}, int(i*5003%40000))
+	}
+	for i := uint64(1); i <= 40; i++ {
+		w.Write(i, entry(i))
+		if i == 4 && len(w.vectors) != 1 {
+			t.Error(w.vectors)
+		}
+		if i%3 == 0 {
+			w.Flush()
+		}
+	}
+	w.Flush()
+	if len(w.vectors) != 0 || w.retainedSize != 0 {
+		t.Error(w.vectors, w.retainedSize)
+	}
+	check := func() {
+		for i := uint64(1); i <= 40; i++ {
+			if data, err := w.Read(i); err != nil || !bytes.Equal(data, entry(i)) {
+				t.Error(i, len(data), err)
+			}
+		}
+	}
+	check()
+	w.Close()
+	if w, err = Open(file, opts); err != nil {
+		t.Error(err)
+	}
+	check()
+	w.Close()
+	os.RemoveAll(file)
+}
+
+func TestConsume(t *testing.T) {
+	bufs := consume([][]byte{{1, 2}, {}, {3, 4, 5}, {6}}, 3)
+	if len(bufs) != 2 || !bytes.Equal(bufs[0], []byte{4, 5}) || !bytes.Equal(bufs[1], []byte{6}) {
+		t.Error(bufs)
+	}
+	if bufs = consume(bufs, 3); len(bufs) != 0 {
+		t.Error(bufs)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	file := "wal"
+	checkpoint := "wal-checkpoint"
+	for _, mode := range []struct{ dir, file os.FileMode }{{0700, 0600}, {0750, 0640}} {
+		os.RemoveAll(file)
+		opts := &Options{SegmentEntries: 4, DirMode: mode.dir, FileMode: mode.file}
+		w, err := Open(file, opts)
+		if err != nil {
+			t.Error(err)
+		}
+		for i := uint64(1); i <= 10; i++ {
+			w.Write(i, []byte{0, 0, byte(i)})
+		}
+		w.Flush()
+		// the clean and truncate files are renamed from the temporary file
+		if err = w.Clean(3); err != nil {
+			t.Error(err)
+		}
+		if err = w.Truncate(9); err != nil {
+			t.Error(err)
+		}
+		if err = w.SetAppliedIndex(5); err != nil {
+			t.Error(err)
+		}
+		os.RemoveAll(checkpoint)
+		if err = w.Checkpoint(checkpoint); err != nil {
+			t.Error(err)
+		}
+		w.Close()
+		check := func(path string) {
+			if info, err := os.Stat(path); err != nil || info.Mode().Perm() != mode.dir {
+				t.Error(path, info.Mode(), err)
+			}
+			infos, err := ioutil.ReadDir(path)
+			if err != nil {
+				t.Error(err)
+			}
+			for _, info := range infos {
+				if info.Mode().Perm() != mode.file {
+					t.Error(path, info.Name(), info.Mode())
+				}
+			}
+		}
+		check(file)
+		check(checkpoint)
+		if err = Restore(checkpoint, file, opts); err != nil {
+			t.Error(err)
+		}
+		check(file)
+	}
+	os.RemoveAll(file)
+	os.RemoveAll(checkpoint)
+}
+
+func TestSyncMode(t *testing.T) {
+	file := "wal"
+	for _, mode := range []SyncMode{SyncFsync, SyncFdatasync, SyncDsync} {
+		os.RemoveAll(file)
+		opts := &Options{SegmentEntries: 4, SyncMode: mode}
+		w, err := Open(file, opts)
+		if err != nil {
+			t.Error(err)
+		}
+		for i := uint64(1); i <= 10; i++ {
+			w.Write(i, []byte{0, 0, byte(i)})
+			if err = w.Flush(); err != nil {
+				t.Error(err)
+			}
+			if err = w.Sync(); err != nil {
+				t.Error(err)
+			}
+		}
+		w.Close()
+		if w, err = Open(file, opts); err != nil {
+			t.Error(err)
+		}
+		for i := uint64(1); i <= 10; i++ {
+			if data, err := w.Read(i); err != nil || data[2] != byte(i) {
+				t.Error(mode, i, data, err)
+			}
+		}
+		w.Close()
+	}
+	os.RemoveAll(file)
 }
 
 func TestCleanTruncate(t *testing.T) {
@@ -149,7 +411,7 @@ func TestCleanTruncate(t *testing.T) {
 		_, end := s.readIndex(s.len)
 		offset := int(start)
 		size := int(end - start)
-		if err = w.copy(s.logPath, cleanName, offset, size); err != nil {
+		if err = w.copy(context.Background(), s.logPath, cleanName, offset, size); err != nil {
 			return err
 		}
 		return nil
@@ -171,7 +433,7 @@ func TestCleanTruncate(t *testing.T) {
 		_, end := s.readIndex(index)
 		offset := int(start)
 		size := int(end - start)
-		if err = w.copy(s.logPath, truncateName, offset, size); err != nil {
+		if err = w.copy(context.Background(), s.logPath, truncateName, offset, size); err != nil {
 			return err
 		}
 		return nil
@@ -206,6 +468,36 @@ func TestCleanTruncateMore(t *testing.T) {
 	os.RemoveAll(file)
 }
 
+func TestCopyMode(t *testing.T) {
+	file := "wal"
+	for _, opts := range []*Options{
+		{SegmentEntries: 8, CopyBufferSize: 5},
+		{SegmentEntries: 8, MmapCopy: true},
+	} {
+		os.RemoveAll(file)
+		w, err := Open(file, opts)
+		if err != nil {
+			t.Error(err)
+		}
+		for i := uint64(1); i <= 12; i++ {
+			w.Write(i, []byte{0, 1, 2, byte(i)})
+		}
+		if err = w.Clean(3); err != nil {
+			t.Error(err)
+		}
+		if err = w.Truncate(6); err != nil {
+			t.Error(err)
+		}
+		for i := uint64(3); i <= 6; i++ {
+			if data, err := w.Read(i); err != nil || data[3] != byte(i) {
+				t.Error(i, data, err)
+			}
+		}
+		w.Close()
+	}
+	os.RemoveAll(file)
+}
+
 func TestNoSplitSegment(t *testing.T) {
 	file := "wal"
 	os.RemoveAll(file)
@@ -227,6 +519,59 @@ func TestNoSplitSegment(t *testing.T) {
 	os.RemoveAll(file)
 }
 
+func TestLogicalClean(t *testing.T) {
+	file := "wal"
+	os.RemoveAll(file)
+	opts := &Options{SegmentEntries: 4, LogicalClean: true, RecordTime: true}
+	w, err := Open(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	start := time.Now()
+	for i := uint64(1); i <= 10; i++ {
+		w.Write(i, []byte{0, 0, byte(i)})
+	}
+	w.Flush()
+	logPath := w.segments[1].logPath
+	info, _ := os.Stat(logPath)
+	if err = w.Clean(7); err != nil {
+		t.Error(err)
+	}
+	if after, _ := os.Stat(logPath); after.Size() != info.Size() {
+		t.Error(after.Size(), info.Size())
+	}
+	check := func() {
+		if index, _ := w.FirstIndex(); index != 7 {
+			t.Error(index)
+		}
+		if _, err := w.Read(6); err != ErrOutOfRange {
+			t.Error(err)
+		}
+		for i := uint64(7); i <= 10; i++ {
+			if data, err := w.Read(i); err != nil || data[2] != byte(i) {
+				t.Error(i, data, err)
+			}
+		}
+		if index, err := w.IndexAt(start); err != nil || index != 7 {
+			t.Error(index, err)
+		}
+	}
+	check()
+	w.Close()
+	if w, err = Open(file, opts); err != nil {
+		t.Error(err)
+	}
+	check()
+	if err = w.Clean(9); err != nil {
+		t.Error(err)
+	}
+	if _, err = os.Stat(logPath); !os.IsNotExist(err) {
+		t.Error(err)
+	}
+	w.Close()
+	os.RemoveAll(file)
+}
+
 func TestParseSegmentName(t *testing.T) {
 	file := "wal"
 	os.RemoveAll(file)
@@ -339,6 +684,28 @@ func TestClose(t *testing.T) {
 	os.RemoveAll(file)
 }
 
+func TestReadBeforeFlush(t *testing.T) {
+	file := "wal"
+	os.RemoveAll(file)
+	w, err := Open(file, nil)
+	if err != nil {
+		t.Error(err)
+	}
+	w.Write(1, []byte("Hello"))
+	w.Flush()
+	w.Write(2, []byte("World"))
+	w.Read(1)
+	w.Flush()
+	if data, err := w.Read(1); err != nil || string(data) != "Hello" {
+		t.Error(string(data), err)
+	}
+	if data, err := w.Read(2); err != nil || string(data) != "World" {
+		t.Error(string(data), err)
+	}
+	w.Close()
+	os.RemoveAll(file)
+}
+
 func BenchmarkWalWrite(b *testing.B) {
 	file := "wal"
 	os.RemoveAll(file)
@@ -356,6 +723,37 @@ func BenchmarkWalWrite(b *testing.B) {
 	os.RemoveAll(file)
 }
 
+func BenchmarkWalWriteFsync(b *testing.B) {
+	benchmarkWalWriteSyncMode(b, SyncFsync)
+}
+
+func BenchmarkWalWriteFdatasync(b *testing.B) {
+	benchmarkWalWriteSyncMode(b, SyncFdatasync)
+}
+
+func BenchmarkWalWriteDsync(b *testing.B) {
+	benchmarkWalWriteSyncMode(b, SyncDsync)
+}
+
+func benchmarkWalWriteSyncMode(b *testing.B, mode SyncMode) {
+	file := "wal"
+	os.RemoveAll(file)
+	w, err := Open(file, &Options{SyncMode: mode})
+	if err != nil {
+		b.Error(err)
+	}
+	data := make([]byte, 512)
+	var index uint64
+	for i := 0; i < b.N; i++ {
+		index++
+		w.Write(index, data)
+		w.Flush()
+		w.Sync()
+	}
+	w.Close()
+	os.RemoveAll(file)
+}
+
 func BenchmarkWalWriteNoSync(b *testing.B) {
 	file := "wal"
 	os.RemoveAll(file)
@@ -378,6 +776,47 @@ func BenchmarkWalWriteNoSync(b *testing.B) {
 	os.RemoveAll(file)
 }
 
+// BenchmarkWalWriteLarge compares copying large entries to the write buffer
+// with retaining them by NoCopy. NoCopy only retains the entries of at least
+// noCopyThreshold (16 KiB) and copies smaller ones, so the NoCopy case runs
+// only from that size.
+func BenchmarkWalWriteLarge(b *testing.B) {
+	for _, size := range []int{4 << 10, noCopyThreshold, 64 << 10, 1 << 20} {
+		for _, noCopy := range []bool{false, true} {
+			if noCopy && size < noCopyThreshold {
+				continue
+			}
+			name := fmt.Sprintf("%dKiB/Copy", size>>10)
+			if noCopy {
+				name = fmt.Sprintf("%dKiB/NoCopy", size>>10)
+			}
+			b.Run(name, func(b *testing.B) {
+				file := "wal"
+				os.RemoveAll(file)
+				w, err := Open(file, &Options{NoCopy: noCopy})
+				if err != nil {
+					b.Error(err)
+				}
+				data := make([]byte, size)
+				b.SetBytes(int64(size))
+				b.ResetTimer()
+				var index uint64
+				for i := 0; i < b.N; i++ {
+					index++
+					w.Write(index, data)
+					if index%16 == 0 {
+						w.Flush()
+					}
+				}
+				w.Flush()
+				b.StopTimer()
+				w.Close()
+				os.RemoveAll(file)
+			})
+		}
+	}
+}
+
 func BenchmarkWalRead(b *testing.B) {
 	file := "wal"
 	os.RemoveAll(file)
@@ -399,3 +838,56 @@ func BenchmarkWalRead(b *testing.B) {
 	}
 	os.RemoveAll(file)
 }
+
+func TestWriteRecord(t *testing.T) {
+	file, copyFile := "wal", "wal-copy"
+	os.RemoveAll(file)
+	os.RemoveAll(copyFile)
+	opts := &Options{SegmentEntries: 4, RecordTime: true}
+	w, err := Open(file, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	c, err := Open(copyFile, opts)
+	if err != nil {
+		t.Error(err)
+	}
+	for i := uint64(1); i <= 10; i++ {
+		w.WriteKey(i, []byte("key"), []byte(fmt.Sprintf("entry-%d", i)))
+	}
+	w.Flush()
+	for i := uint64(1); i <= 10; i++ {
+		record, err := w.ReadRecord(i)
+		if err != nil {
+			t.Error(i, err)
+		}
+		if i > 1 {
+			if err = c.WriteRecord(i+1, record); err != ErrOutOfOrder {
+				t.Error(i, err)
+			}
+		}
+		if err = c.WriteRecord(i, record[:len(record)-1]); err != ErrUnexpectedSize {
+			t.Error(i, err)
+		}
+		if err = c.WriteRecord(i, record); err != nil {
+			t.Error(i, err)
+		}
+	}
+	if c.lastTime != w.lastTime {
+		t.Error(c.lastTime, w.lastTime)
+	}
+	c.Flush()
+	for i := uint64(1); i <= 10; i++ {
+		record, _ := w.ReadRecord(i)
+		if crecord, err := c.ReadRecord(i); err != nil || !bytes.Equal(crecord, record) {
+			t.Error(i, err)
+		}
+		if key, value, err := c.ReadKey(i); err != nil || string(key) != "key" || string(value) != fmt.Sprintf("entry-%d", i) {
+			t.Error(i, string(key), string(value), err)
+		}
+	}
+	w.Close()
+	c.Close()
+	os.RemoveAll(file)
+	os.RemoveAll(copyFile)
+}
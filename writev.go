@@ -0,0 +1,44 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+package wal
+
+// noCopyThreshold is the minimum size of the data retained by the NoCopy option.
+const noCopyThreshold = 16 << 10
+
+// vector is the retained data that follows the write buffer before end.
+type vector struct {
+	end  int
+	data []byte
+}
+
+// buffered returns the size of the data to flush.
+func (w *WAL) buffered() int {
+	return len(w.writeBuffer) + w.retainedSize
+}
+
+// buffers returns the write buffer interleaved with the retained data.
+func (w *WAL) buffers() [][]byte {
+	bufs := make([][]byte, 0, len(w.vectors)*2+1)
+	var start int
+	for _, v := range w.vectors {
+		bufs = append(bufs, w.writeBuffer[start:v.end], v.data)
+		start = v.end
+	}
+	if start < len(w.writeBuffer) {
+		bufs = append(bufs, w.writeBuffer[start:])
+	}
+	return bufs
+}
+
+// consume removes the first n bytes from the buffers.
+func consume(bufs [][]byte, n int) [][]byte {
+	for len(bufs) > 0 && n >= len(bufs[0]) {
+		n -= len(bufs[0])
+		bufs = bufs[1:]
+	}
+	if len(bufs) > 0 {
+		bufs[0] = bufs[0][n:]
+	}
+	return bufs
+}
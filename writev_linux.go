@@ -0,0 +1,48 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+//go:build linux
+// +build linux
+
+package wal
+
+import (
+	"io"
+	"syscall"
+	"unsafe"
+)
+
+// maxIovecs is the maximum number of buffers of a writev.
+const maxIovecs = 1024
+
+// writev writes the buffers to the file by the writev system call.
+func writev(f file, bufs [][]byte) error {
+	iovecs := make([]syscall.Iovec, 0, maxIovecs)
+	for len(bufs) > 0 {
+		iovecs = iovecs[:0]
+		for _, buf := range bufs {
+			if len(iovecs) == maxIovecs {
+				break
+			}
+			if len(buf) == 0 {
+				continue
+			}
+			iovec := syscall.Iovec{Base: &buf[0]}
+			iovec.SetLen(len(buf))
+			iovecs = append(iovecs, iovec)
+		}
+		if len(iovecs) == 0 {
+			return nil
+		}
+		n, _, errno := syscall.Syscall(syscall.SYS_WRITEV, f.Fd(), uintptr(unsafe.Pointer(&iovecs[0])), uintptr(len(iovecs)))
+		if errno == syscall.EINTR {
+			continue
+		} else if errno != 0 {
+			return errno
+		} else if n == 0 {
+			return io.ErrShortWrite
+		}
+		bufs = consume(bufs, int(n))
+	}
+	return nil
+}
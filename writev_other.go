@@ -0,0 +1,17 @@
+// Copyright (c) 2020 Meng Huang (mhboy@outlook.com)
+// This package is licensed under a MIT license that can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package wal
+
+// writev writes the buffers to the file one by one.
+func writev(f file, bufs [][]byte) error {
+	for _, buf := range bufs {
+		if _, err := f.Write(buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}